@@ -0,0 +1,96 @@
+package dlog
+
+import (
+	"time"
+)
+
+// Clock 时间来源，测试时可以替换成固定时间
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock 系统时间
+type systemClock struct{}
+
+// Now 当前系统时间
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// cur_time 的特殊格式，输出为数字
+const (
+	TimeFormatUnix      = "unix"       // 秒
+	TimeFormatUnixMilli = "unix_milli" // 毫秒
+	TimeFormatUnixNano  = "unix_nano"  // 纳秒
+)
+
+var (
+	_clock        Clock          = systemClock{}
+	_timeLocation *time.Location // 为nil时使用本地时区
+	_timeFormat   = time.RFC3339Nano
+	_unixTimeUnit = time.Second
+)
+
+// SetClock 设置时间来源，日志时间和 FileBackend 的文件切分都使用它，传nil恢复系统时间
+func SetClock(c Clock) {
+	if c == nil {
+		c = systemClock{}
+	}
+	_clock = c
+}
+
+// SetTimeLocation 设置日志时间和文件切分使用的时区，比如 time.UTC，传nil恢复本地时区
+func SetTimeLocation(loc *time.Location) {
+	_timeLocation = loc
+}
+
+// SetTimeFormat 设置 cur_time 的格式，可以是 time.Format 的layout，也可以是 TimeFormatUnix 等数字格式
+func SetTimeFormat(layout string) {
+	if len(layout) <= 0 {
+		layout = time.RFC3339Nano
+	}
+	_timeFormat = layout
+}
+
+// SetUnixTimeUnit 设置 cur_unix_time 的单位，支持 time.Second(默认) time.Millisecond time.Microsecond time.Nanosecond
+func SetUnixTimeUnit(unit time.Duration) {
+	if unit <= 0 {
+		unit = time.Second
+	}
+	_unixTimeUnit = unit
+}
+
+// now 按设置的时区获取当前时间
+func now() time.Time {
+	return nowFrom(_clock)
+}
+
+// nowFrom 按设置的时区从c获取当前时间
+func nowFrom(c Clock) time.Time {
+	t := c.Now()
+	if _timeLocation != nil {
+		t = t.In(_timeLocation)
+	}
+	return t
+}
+
+// formatTime 按 SetTimeFormat 格式化 cur_time
+func formatTime(t time.Time) interface{} {
+	switch _timeFormat {
+	case TimeFormatUnix:
+		return t.Unix()
+	case TimeFormatUnixMilli:
+		return t.UnixNano() / int64(time.Millisecond)
+	case TimeFormatUnixNano:
+		return t.UnixNano()
+	}
+	return t.Format(_timeFormat)
+}
+
+// unixTime 按 SetUnixTimeUnit 计算 cur_unix_time
+func unixTime(t time.Time) int64 {
+	if _unixTimeUnit == time.Second {
+		return t.Unix()
+	}
+	return t.UnixNano() / int64(_unixTimeUnit)
+}
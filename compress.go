@@ -0,0 +1,154 @@
+package dlog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressFormat 切分后历史文件的压缩格式
+type CompressFormat uint8
+
+const (
+	CompressNone CompressFormat = iota // 默认，不压缩
+	CompressGzip                       // 压缩为 .gz
+	CompressZstd                       // 压缩为 .zst
+)
+
+// compressSuffixes 压缩文件的后缀，带这些后缀的文件即已经压缩完成
+var compressSuffixes = []string{".gz", ".zst"}
+
+// compressTmpSuffix 压缩过程中的临时文件后缀，压缩完成后 rename 成正式文件名
+const compressTmpSuffix = ".tmp"
+
+// suffix 压缩后的文件后缀
+func (f CompressFormat) suffix() string {
+	switch f {
+	case CompressGzip:
+		return ".gz"
+	case CompressZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// isCompressed 文件名是否是已经压缩完成的文件
+func isCompressed(filePath string) bool {
+	for _, suffix := range compressSuffixes {
+		if strings.HasSuffix(filePath, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressor 后台压缩已经切分走的文件，直到 FileBackend 关闭
+func (p *FileBackend) compressor() {
+	defer close(p.compressDone)
+	p.compressFiles()
+	for {
+		select {
+		case <-p.compressCh:
+			p.compressFiles()
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+// compressFiles 压缩所有还没有压缩的历史文件，最多同时压缩 CompressWorkers 个，关闭后不再开始新的压缩
+func (p *FileBackend) compressFiles() {
+	sem := make(chan struct{}, p.compressWorkers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, f := range p.listFiles() {
+		if isCompressed(f.path) || p.inRotateCallback(f.path) {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-p.closeCh:
+			return
+		}
+		wg.Add(1)
+		go func(filePath string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if p.isCurrentFile(filePath) {
+				return
+			}
+			if err := compressFile(filePath, p.compress); err != nil {
+				internalLog("FileBackend: compress %s failed: %v", filePath, err)
+			}
+		}(f.path)
+	}
+}
+
+// isCurrentFile 是否是正在写的文件
+// 遍历目录期间可能发生切分，新打开的文件也会被列出来，所以压缩和删除之前要在 p.mu 下重新判断
+func (p *FileBackend) isCurrentFile(filePath string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return filePath == p.filePath
+}
+
+// compressFile 把文件压缩到临时文件，sync 后 rename 成 filePath+后缀，最后删除原文件
+func compressFile(filePath string, format CompressFormat) (err error) {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dstPath := filePath + format.suffix()
+	tmpPath := dstPath + compressTmpSuffix
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm()) // 和原文件的权限相同
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+	var w io.WriteCloser
+	switch format {
+	case CompressZstd:
+		if w, err = zstd.NewWriter(dst); err != nil {
+			return err
+		}
+	default:
+		w = gzip.NewWriter(dst)
+	}
+	if _, err = io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if err = dst.Sync(); err != nil {
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	// 保留原文件的修改时间，按 MaxAge 清理和 ReadTimeRange 都依赖它
+	if err = os.Chtimes(tmpPath, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, dstPath); err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
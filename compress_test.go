@@ -0,0 +1,62 @@
+package dlog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCompressKeepsCurrentFile 频繁切分时 compressor 不能压缩并删除正在写的文件，Close 之后所有日志都能读回来
+func TestCompressKeepsCurrentFile(t *testing.T) {
+	dir := t.TempDir()
+	fb, err := NewFileBackendWithConfig(dir, "compress.log", FileBackendConfig{
+		MaxSize:       512,
+		FlushInterval: time.Millisecond,
+		Compress:      CompressGzip,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const lines = 2000
+	for i := 0; i < lines; i++ {
+		fb.Write([]byte(fmt.Sprintf("%d %s\n", i, strings.Repeat("x", 60))))
+	}
+	if err := fb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "compress.log*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(name, CompressGzip.suffix()) {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			r = zr
+		}
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			seen[strings.Fields(sc.Text())[0]] = true
+		}
+		f.Close()
+	}
+	for i := 0; i < lines; i++ {
+		if !seen[fmt.Sprint(i)] {
+			t.Fatalf("line %d lost", i)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package dlog
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/labstack/gommon/color"
+)
+
+// ConsoleMode dLogWriter 把日志同时输出到控制台的方式
+type ConsoleMode uint8
+
+const (
+	ConsoleStdout ConsoleMode = iota // 默认，输出到stdout
+	ConsoleOff                       // 不输出到控制台，比如在k8s中避免日志被采集两次
+	ConsoleStderr                    // 输出到stderr
+)
+
+// writer 控制台对应的writer，ConsoleOff 时为nil
+func (m ConsoleMode) writer() io.Writer {
+	switch m {
+	case ConsoleOff:
+		return nil
+	case ConsoleStderr:
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// ConsoleEncoder 控制台输出的格式，b 为写入文件的一行日志，返回输出到控制台的内容
+type ConsoleEncoder func(v Lvl, b []byte) []byte
+
+// _consoleColor ColorConsoleEncoder 使用，总是输出颜色，不管stdout是不是终端
+var _consoleColor = func() *color.Color {
+	c := color.New()
+	c.Enable()
+	return c
+}()
+
+// ColorConsoleEncoder 按日志级别给整行加上颜色，DEBUG 青色，WARN 黄色，ERROR FATAL 红色，适合在终端中查看
+func ColorConsoleEncoder(v Lvl, b []byte) []byte {
+	line := string(bytes.TrimRight(b, "\n"))
+	switch v {
+	case DEBUG:
+		line = _consoleColor.Cyan(line)
+	case WARN:
+		line = _consoleColor.Yellow(line)
+	case ERROR, FATAL:
+		line = _consoleColor.Red(line)
+	}
+	return append([]byte(line), '\n')
+}
+
+// appendConsole 按 ConsoleLevel 和 ConsoleEncoder 把要输出到控制台的内容追加到b
+// 通过 Write 写入的日志(比如文本日志 dLog)不知道级别，总是输出
+func (w *dLogWriter) appendConsole(b []byte, line logLine) []byte {
+	if w.console == nil || (line.level > 0 && line.level < w.consoleLevel) {
+		return b
+	}
+	if w.consoleEncoder != nil {
+		return append(b, w.consoleEncoder(line.level, []byte(line.data))...)
+	}
+	return append(b, line.data...)
+}
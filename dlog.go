@@ -63,15 +63,19 @@ func (p *dLog) logStr(ctxExternal context.Context, kv ...interface{}) string {
 		pre = []interface{}{"local_machine_ipv4", localMachineIPV4, TraceID, ValueFromOM(ctxExternal, TraceID),
 			SpanID, ValueFromOM(ctxExternal, SpanID), ParentID, ValueFromOM(ctxExternal, ParentID), UserRequestIP, ValueFromOM(ctxExternal, UserRequestIP)}
 	}
-	kv = append(pre, kv...)
-	if len(kv)%2 != 0 {
-		kv = append(kv, "unknown")
+	pairs, problems := parseKV(kv)
+	if msg := badKVMessage(problems, file, line); len(msg) > 0 {
+		p.Warnf("%s", msg)
 	}
 	strFmt := "%s %d "
 	args := []interface{}{file, line}
-	for i := 0; i < len(kv); i += 2 {
+	for i := 0; i < len(pre); i += 2 {
 		strFmt += "[%v=%+v]"
-		args = append(args, kv[i], kv[i+1])
+		args = append(args, pre[i], pre[i+1])
+	}
+	for _, pair := range pairs {
+		strFmt += "[%v=%+v]"
+		args = append(args, pair.key, textValue(pair.val))
 	}
 	str := fmt.Sprintf(strFmt, args...)
 	return str
@@ -2,41 +2,45 @@ package dlog
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"github.com/dajinkuang/util/glsutil"
 	"github.com/dajinkuang/util/ordermaputil"
 	"io"
+	"os"
 	"path"
 	"runtime"
-	"time"
 
-	"github.com/dajinkuang/util/iputil"
 	"github.com/labstack/gommon/color"
 )
 
 // SetTopic 设置日志Topic，在main中修改
+// 所有日志写入 <topic>.log_json_std，ERROR 及以上级别再写一份到 <topic>.log_json_error，见 DefaultRoutes
 func SetTopic(topic string, absolutePath string) {
-	if _dLogJSON != nil {
-		_dLogJSON.Close()
-		_dLogJSONError.Close()
-	}
-	dir := "/tmp/go/log"
-	if len(absolutePath) > 0 {
-		dir = absolutePath
-	}
-	file, err := NewFileBackend(dir, topic+".log_json_std")
-	if err != nil {
-		panic(err)
+	SetTopicRoutes(topic, absolutePath, DefaultRoutes(topic)...)
+}
+
+// newTopicBackend 新建 SetTopic 使用的 FileBackend，失败时写到stderr，不再panic
+func newTopicBackend(dir, name string, cfg FileBackendConfig) io.WriteCloser {
+	if len(cfg.JournalPath) > 0 {
+		cfg.JournalPath += "." + name // 每个文件一个崩溃恢复缓冲
 	}
-	_dLogJSON = NewDLogJSON(file, topic)
-	SetLogger(_dLogJSON)
-	fileErrorAbove, err := NewFileBackend(dir, topic+".log_json_error")
+	file, err := NewFileBackendWithConfig(dir, name, cfg)
 	if err != nil {
-		panic(err)
+		internalLog("dlog: NewFileBackend %s/%s failed, write to stderr: %v", dir, name, err)
+		return stderrWriteCloser{}
 	}
-	_dLogJSONError = NewDLogJSON(fileErrorAbove, topic)
-	SetLoggerError(_dLogJSONError)
+	return file
+}
+
+// stderrWriteCloser 写到stderr，Close 不关闭stderr
+type stderrWriteCloser struct{}
+
+// Write 写到stderr
+func (stderrWriteCloser) Write(b []byte) (int, error) {
+	return os.Stderr.Write(b)
+}
+
+// Close 什么也不做
+func (stderrWriteCloser) Close() error {
+	return nil
 }
 
 // _dLogJSON 可以打印任何级别的日志
@@ -69,10 +73,19 @@ type dLogJSON struct {
 	levels []string
 	color  *color.Color
 	dw     *dLogWriter
+	routes []*route // 不为空时按路由写入多个文件，见 NewDLogJSONRoutes
 }
 
 // NewDLogJSON 新建一个dLogJSON
 func NewDLogJSON(w io.WriteCloser, topic string) *dLogJSON {
+	l := newDLogJSON(topic)
+	l.dw = NewDLogWriter(w)
+	l.SetOutput(l.dw)
+	return l
+}
+
+// newDLogJSON 新建一个还没有设置writer的dLogJSON
+func newDLogJSON(topic string) *dLogJSON {
 	if len(topic) <= 0 {
 		topic = defaultTopic
 	}
@@ -82,8 +95,6 @@ func NewDLogJSON(w io.WriteCloser, topic string) *dLogJSON {
 		color:  color.New(),
 	}
 	l.initLevels()
-	l.dw = NewDLogWriter(w)
-	l.SetOutput(l.dw)
 	l.SetLevel(INFO)
 	return l
 }
@@ -94,11 +105,19 @@ func (dl *dLogJSON) With(ctx context.Context, kv ...interface{}) context.Context
 	if om == nil {
 		om = ordermaputil.NewOrderMap()
 	}
-	if len(kv)%2 != 0 {
-		kv = append(kv, "unknown")
+	pairs, problems := parseKV(kv)
+	if len(problems) > 0 {
+		file, line := externalCaller()
+		if w := badKVEntry(ctx, dl.Prefix(), problems, file, line); w != nil {
+			dl.writeEntry(WARN, w)
+		}
 	}
-	for i := 0; i < len(kv); i += 2 {
-		om.Set(fmt.Sprintf("%v", kv[i]), kv[i+1])
+	for _, pair := range pairs {
+		val, err := safeValue(pair.val)
+		om.Set(pair.key, val)
+		if err != nil {
+			om.Set(pair.key+"_error", err.Error())
+		}
 	}
 	return setContext(ctx, om)
 }
@@ -108,48 +127,23 @@ func (dl *dLogJSON) logJSON(ctxExternal context.Context, v Lvl, kv ...interface{
 	if v < dl.level {
 		return nil
 	}
-	om := ordermaputil.NewOrderMap()
 	_, file, line, _ := runtime.Caller(3)
 	file = dl.getFilePath(file)
-	om.Set("dlog_prefix", dl.Prefix())
-	om.Set("level", dl.levels[v])
-	now := time.Now()
-	om.Set("cur_time", now.Format(time.RFC3339Nano))
-	om.Set("cur_unix_time", now.Unix())
-	om.Set("file", file)
-	om.Set("line", line)
-	localMachineIPV4, _ := iputil.LocalMachineIPV4()
-	om.Set("local_machine_ipv4", localMachineIPV4)
-	if ctxExternal == nil {
-		ctxGls, ctxIsDefault := glsutil.GlsContext()
-		if !ctxIsDefault {
-			om.Set(TraceID, ValueFromOM(ctxGls, TraceID))
-			om.Set(SpanID, ValueFromOM(ctxGls, SpanID))
-			om.Set(ParentID, ValueFromOM(ctxGls, ParentID))
-			om.Set(UserRequestIP, ValueFromOM(ctxGls, UserRequestIP))
-			om.AddValues(FromContext(ctxGls))
-		} else {
-			traceID, pSpanID, spanID := glsutil.GetOpenTracingFromGls()
-			om.Set(TraceID, traceID)
-			om.Set(SpanID, spanID)
-			om.Set(ParentID, pSpanID)
-		}
-	} else {
-		om.Set(TraceID, ValueFromOM(ctxExternal, TraceID))
-		om.Set(SpanID, ValueFromOM(ctxExternal, SpanID))
-		om.Set(ParentID, ValueFromOM(ctxExternal, ParentID))
-		om.Set(UserRequestIP, ValueFromOM(ctxExternal, UserRequestIP))
-		om.AddValues(FromContext(ctxExternal))
+	e := newStdLogEntry(ctxExternal, dl.Prefix(), dl.levels[v], file, line)
+	problems := e.addKV(kv...)
+	if w := badKVEntry(ctxExternal, dl.Prefix(), problems, file, line); w != nil {
+		dl.writeEntry(WARN, w)
 	}
-	if len(kv)%2 != 0 {
-		kv = append(kv, "unknown")
-	}
-	for i := 0; i < len(kv); i += 2 {
-		om.Set(fmt.Sprintf("%v", kv[i]), kv[i+1])
+	return dl.writeEntry(v, e)
+}
+
+// writeEntry 编码后写入 Output，设置了路由时写入匹配的路由
+func (dl *dLogJSON) writeEntry(v Lvl, e *logEntry) (err error) {
+	str := append(e.encode(), '\n')
+	if len(dl.routes) > 0 {
+		return dl.writeRoutes(v, e, str)
 	}
-	str, _ := json.Marshal(om)
-	str = append(str, []byte("\n")...)
-	_, err = dl.Output().Write(str)
+	_, err = writeLevel(dl.Output(), v, str)
 	return
 }
 
@@ -210,11 +204,35 @@ func (dl *dLogJSON) getFilePath(file string) string {
 
 // Close 关闭日志打印
 func (dl *dLogJSON) Close() error {
+	return dl.CloseContext(context.Background())
+}
+
+// CloseContext 关闭日志打印，等到已经打印的日志都写入文件，ctx 结束时放弃剩下的日志并返回错误
+func (dl *dLogJSON) CloseContext(ctx context.Context) (err error) {
 	if dl.dw != nil {
-		dl.dw.Close()
+		err = dl.dw.CloseContext(ctx)
 		dl.dw = nil
 	}
-	return nil
+	for _, r := range dl.routes {
+		if closeErr := r.dw.CloseContext(ctx); err == nil {
+			err = closeErr
+		}
+	}
+	dl.routes = nil
+	return
+}
+
+// Flush 等到已经打印的日志都写入文件，ctx 结束时返回错误
+func (dl *dLogJSON) Flush(ctx context.Context) (err error) {
+	if dl.dw != nil {
+		err = dl.dw.Flush(ctx)
+	}
+	for _, r := range dl.routes {
+		if flushErr := r.dw.Flush(ctx); err == nil {
+			err = flushErr
+		}
+	}
+	return
 }
 
 // EnableDebug 开启debug日志
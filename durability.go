@@ -0,0 +1,56 @@
+package dlog
+
+import (
+	"io"
+	"time"
+)
+
+// syncDuration DurabilitySyncInterval 默认的fsync间隔
+const syncDuration = time.Second
+
+// Durability FileBackend 的持久化方式
+type Durability uint8
+
+const (
+	DurabilityBuffered     Durability = iota // 默认，buffer 满了或者每 FlushInterval 写入文件
+	DurabilityFlushEach                      // 每条日志都立即写入文件，不fsync
+	DurabilitySyncInterval                   // 同 DurabilityBuffered，另外每 SyncInterval 写入文件并fsync一次
+	DurabilitySyncError                      // 同 DurabilityBuffered，ERROR 及以上级别的日志立即写入文件并fsync
+)
+
+// LevelWriter 可以感知日志级别的writer，FileBackend 用它实现 DurabilitySyncError
+type LevelWriter interface {
+	io.Writer
+	WriteLevel(v Lvl, b []byte) (n int, err error)
+}
+
+// writeLevel w 实现了 LevelWriter 时带上日志级别写入
+func writeLevel(w io.Writer, v Lvl, b []byte) (int, error) {
+	if lw, ok := w.(LevelWriter); ok {
+		return lw.WriteLevel(v, b)
+	}
+	return w.Write(b)
+}
+
+// WriteLevel 带日志级别的写操作，DurabilitySyncError 时 ERROR 及以上级别立即写入文件并fsync
+func (p *FileBackend) WriteLevel(v Lvl, b []byte) (n int, err error) {
+	return p.writeJournaled(v, b, nil, []int64{p.journalAppend(b)})
+}
+
+// sync 写入文件并fsync，调用时需要持有 p.mu
+func (p *FileBackend) sync() error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Sync()
+}
+
+// Sync 写入文件并fsync
+func (p *FileBackend) Sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sync()
+}
@@ -0,0 +1,278 @@
+package dlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/dajinkuang/util/glsutil"
+	"github.com/dajinkuang/util/iputil"
+	"github.com/dajinkuang/util/ordermaputil"
+)
+
+// _marshalErrorCount 字段编码失败的次数
+var _marshalErrorCount uint64
+
+// MarshalErrorCount 获取字段编码失败的次数
+func MarshalErrorCount() uint64 {
+	return atomic.LoadUint64(&_marshalErrorCount)
+}
+
+// KeyConflictPolicy 日志字段key重复时的处理方式
+// 字段按 内置字段(level cur_time 等) -> ctx中的字段 -> 调用处的kv 的顺序添加，值相同的重复key直接忽略
+type KeyConflictPolicy uint8
+
+const (
+	KeyConflictPrefix    KeyConflictPolicy = iota // 默认，后添加的key加上 "fields." 前缀，比如 fields.level
+	KeyConflictLastWins                           // 后添加的覆盖之前的
+	KeyConflictFirstWins                          // 保留先添加的，丢弃后添加的
+	KeyConflictArray                              // 两个值都保留，组成数组
+)
+
+// keyConflictPrefix KeyConflictPrefix 使用的前缀
+const keyConflictPrefix = "fields."
+
+var _keyConflictPolicy = KeyConflictPrefix
+
+// SetKeyConflictPolicy 设置字段key重复时的处理方式
+func SetKeyConflictPolicy(policy KeyConflictPolicy) {
+	_keyConflictPolicy = policy
+}
+
+// logEntry 一条日志的有序字段，重复设置同一个key时保留第一次的位置
+type logEntry struct {
+	keys []string
+	vals map[string]interface{}
+}
+
+func newLogEntry() *logEntry {
+	return &logEntry{vals: make(map[string]interface{})}
+}
+
+// newStdLogEntry 生成带有公共字段和trace信息的日志，ctxExternal 为nil时从gls中获取
+func newStdLogEntry(ctxExternal context.Context, prefix, level, file string, line int) *logEntry {
+	e := newLogEntry()
+	e.set("dlog_prefix", prefix)
+	e.set("level", level)
+	t := now()
+	e.set("cur_time", formatTime(t))
+	e.set("cur_unix_time", unixTime(t))
+	e.set("file", file)
+	e.set("line", line)
+	localMachineIPV4, _ := iputil.LocalMachineIPV4()
+	e.set("local_machine_ipv4", localMachineIPV4)
+	ctx := ctxExternal
+	if ctx == nil {
+		ctxGls, ctxIsDefault := glsutil.GlsContext()
+		if ctxIsDefault {
+			traceID, pSpanID, spanID := glsutil.GetOpenTracingFromGls()
+			e.set(TraceID, traceID)
+			e.set(SpanID, spanID)
+			e.set(ParentID, pSpanID)
+			return e
+		}
+		ctx = ctxGls
+	}
+	e.set(TraceID, ValueFromOM(ctx, TraceID))
+	e.set(SpanID, ValueFromOM(ctx, SpanID))
+	e.set(ParentID, ValueFromOM(ctx, ParentID))
+	e.set(UserRequestIP, ValueFromOM(ctx, UserRequestIP))
+	e.addOrderMap(FromContext(ctx))
+	return e
+}
+
+// set 设置字段
+func (e *logEntry) set(key string, val interface{}) {
+	if _, ok := e.vals[key]; !ok {
+		e.keys = append(e.keys, key)
+	}
+	e.vals[key] = val
+}
+
+// add 添加ctx或调用处的字段，key已经存在时按 SetKeyConflictPolicy 处理
+func (e *logEntry) add(key string, val interface{}) {
+	old, ok := e.vals[key]
+	if !ok || _keyConflictPolicy == KeyConflictLastWins {
+		e.set(key, val)
+		return
+	}
+	if sameValue(old, val) {
+		return
+	}
+	switch _keyConflictPolicy {
+	case KeyConflictFirstWins:
+	case KeyConflictArray:
+		if arr, ok := old.(logArray); ok {
+			e.vals[key] = append(arr, val)
+		} else {
+			e.vals[key] = logArray{old, val}
+		}
+	default:
+		e.add(keyConflictPrefix+key, val)
+	}
+}
+
+// sameValue 两个值编码后是否相同
+func sameValue(a, b interface{}) bool {
+	ab, err := marshalValue(a)
+	if err != nil {
+		return false
+	}
+	bb, err := marshalValue(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
+
+// addKV 添加用户传入的kv，kv 应该是成对的数据, 类似: name,张三,age,10,...
+// 返回kv不合法之处的描述，见 parseKV
+func (e *logEntry) addKV(kv ...interface{}) (problems []string) {
+	pairs, problems := parseKV(kv)
+	for _, pair := range pairs {
+		e.add(pair.key, pair.val)
+	}
+	return problems
+}
+
+// addOrderMap 添加ctx中OrderMap的字段
+// OrderMap 只能整体编码，这里按顺序拆回单个字段；整体编码失败时只记录 context_error
+func (e *logEntry) addOrderMap(om *ordermaputil.OrderMap) {
+	if om == nil {
+		return
+	}
+	keys, vals, err := splitOrderMap(om)
+	if err != nil {
+		atomic.AddUint64(&_marshalErrorCount, 1)
+		e.set("context_error", err.Error())
+		return
+	}
+	for i, key := range keys {
+		e.add(key, vals[i])
+	}
+}
+
+// splitOrderMap 把OrderMap编码后按顺序拆成key和已经编码好的value
+func splitOrderMap(om *ordermaputil.OrderMap) (keys []string, vals []json.RawMessage, err error) {
+	b, err := json.Marshal(om)
+	if err != nil {
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err = dec.Token(); err != nil {
+		return nil, nil, err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, fmt.Sprintf("%v", tok))
+		vals = append(vals, raw)
+	}
+	return keys, vals, nil
+}
+
+// encode 逐个字段编码成一行json
+// 某个字段编码失败时用 fallbackValue 的字符串代替，并追加 <key>_error 字段，其它字段照常输出
+func (e *logEntry) encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	first := true
+	writeField := func(key string, val []byte) {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	for _, key := range e.keys {
+		val := e.vals[key]
+		b, err := marshalValue(val)
+		if err == nil {
+			writeField(key, b)
+			continue
+		}
+		atomic.AddUint64(&_marshalErrorCount, 1)
+		b, _ = json.Marshal(fallbackValue(val, err))
+		writeField(key, b)
+		b, _ = json.Marshal(err.Error())
+		writeField(key+"_error", b)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// marshalValue 编码单个值，自定义 Marshaler panic 时也当作编码失败
+func marshalValue(val interface{}) (b []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			b, err = nil, fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return json.Marshal(logValue(val))
+}
+
+// safeValue 给 With 使用，编码失败的值提前换成 fallbackValue 的字符串，避免后续整个OrderMap编码失败
+func safeValue(val interface{}) (ret interface{}, err error) {
+	if _, err = marshalValue(val); err != nil {
+		atomic.AddUint64(&_marshalErrorCount, 1)
+		return fallbackValue(val, err), err
+	}
+	return logValue(val), nil
+}
+
+// fallbackValue 编码失败的值的字符串，比如 NaN、chan、func 输出 %+v 的字符串
+// map slice 指针等可能循环引用的值 %+v 会无限递归导致栈溢出，ObjectMarshaler ArrayMarshaler 会输出本想隐藏的字段，
+// 这些值只输出类型名和错误
+func fallbackValue(val interface{}, err error) string {
+	switch val.(type) {
+	case ObjectMarshaler, ArrayMarshaler:
+	default:
+		if val != nil && plainType(reflect.TypeOf(val), 0) {
+			return fmt.Sprintf("%+v", val)
+		}
+	}
+	return fmt.Sprintf("<%T: %s>", val, err.Error())
+}
+
+// plainType 类型的值不会引用其它值，可以安全地用 %+v 输出，只展开 plainTypeDepth 层 struct array
+func plainType(t reflect.Type, depth int) bool {
+	if depth > plainTypeDepth {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Ptr, reflect.Interface, reflect.UnsafePointer:
+		return false
+	case reflect.Array:
+		return plainType(t.Elem(), depth+1)
+	case reflect.Struct:
+		if t.Implements(_objectMarshalerType) || t.Implements(_arrayMarshalerType) {
+			return false
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if !plainType(t.Field(i).Type, depth+1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// plainTypeDepth plainType 展开 struct array 的最大层数
+const plainTypeDepth = 4
+
+var (
+	_objectMarshalerType = reflect.TypeOf((*ObjectMarshaler)(nil)).Elem()
+	_arrayMarshalerType  = reflect.TypeOf((*ArrayMarshaler)(nil)).Elem()
+)
@@ -0,0 +1,72 @@
+package dlog
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+// secretUser MarshalLogObject 返回错误，编码失败时也不能输出 Password
+type secretUser struct {
+	Name     string
+	Password string
+}
+
+func (u secretUser) MarshalLogObject(enc ObjectEncoder) error {
+	enc.Add("name", u.Name)
+	return errors.New("no permission")
+}
+
+func TestEncodeUnsupportedValues(t *testing.T) {
+	cyclicMap := map[string]interface{}{}
+	cyclicMap["self"] = cyclicMap
+	cyclicSlice := make([]interface{}, 1)
+	cyclicSlice[0] = cyclicSlice
+	// want 为编码失败后 x 字段的值，以 ... 结尾时只比较前缀
+	vals := map[string]struct {
+		val  interface{}
+		want string
+	}{
+		"cyclic_map":   {cyclicMap, "<map[string]interface {}: ..."},
+		"cyclic_slice": {cyclicSlice, "<[]interface {}: ..."},
+		"chan":         {make(chan int), "0x..."},
+		"func":         {func() {}, "0x..."},
+		"nan":          {math.NaN(), "NaN"},
+		"nan_struct":   {struct{ F float64 }{math.NaN()}, "{F:NaN}"},
+		"secret":       {secretUser{Name: "zhangsan", Password: "p@ssw0rd"}, "<dlog.secretUser: ..."},
+	}
+	for key, tc := range vals {
+		val := tc.val
+		e := newLogEntry()
+		e.add("x", val)
+		e.add("after", 1)
+		b := e.encode()
+		var m map[string]interface{}
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatalf("%s: invalid json %s: %v", key, b, err)
+		}
+		if _, ok := m["x_error"]; !ok {
+			t.Errorf("%s: missing x_error in %s", key, b)
+		}
+		got, _ := m["x"].(string)
+		if want := strings.TrimSuffix(tc.want, "..."); want == tc.want && got != want || !strings.HasPrefix(got, want) {
+			t.Errorf("%s: x = %q, want %q", key, got, tc.want)
+		}
+		if m["after"] != float64(1) {
+			t.Errorf("%s: other fields lost in %s", key, b)
+		}
+		if strings.Contains(string(b), "p@ssw0rd") {
+			t.Errorf("%s: secret leaked in %s", key, b)
+		}
+
+		ret, err := safeValue(val)
+		if err == nil {
+			t.Errorf("%s: safeValue should fail", key)
+		}
+		if s, _ := ret.(string); strings.Contains(s, "p@ssw0rd") {
+			t.Errorf("%s: secret leaked by safeValue: %s", key, s)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package dlog
+
+import (
+	"os"
+	"time"
+)
+
+// retryDuration 文件写入或打开失败后的默认重试间隔
+const retryDuration = time.Second * 5
+
+// FallbackMode 文件写不进去并且 buffer 也满了时，新日志的去向
+type FallbackMode uint8
+
+const (
+	FallbackStderr FallbackMode = iota // 默认，写到stderr，stderr 也失败时丢弃
+	FallbackDrop                       // 直接丢弃
+)
+
+// FileBackendStats FileBackend 的错误统计
+type FileBackendStats struct {
+	Errors   uint64 // 打开、写入文件失败的次数
+	Fallback uint64 // 因为文件不可写而写到stderr的日志条数
+	Dropped  uint64 // 丢弃的日志条数
+	// JournalSkipped 崩溃恢复缓冲满了没有记录的条数
+	JournalSkipped uint64
+}
+
+// Stats 获取错误统计
+func (p *FileBackend) Stats() FileBackendStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	if p.journal != nil {
+		p.journal.mu.Lock()
+		stats.JournalSkipped = p.journal.skipped
+		p.journal.mu.Unlock()
+	}
+	return stats
+}
+
+// Err 当前的错误，为nil表示正常写入
+func (p *FileBackend) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// setError 记录错误，进入失败状态，RetryInterval 之后才会重试，调用时需要持有 p.mu
+func (p *FileBackend) setError(err error) {
+	if p.err == nil {
+		internalLog("FileBackend: %s/%s failed, retry every %v: %v", p.dir, p.name, p.retryDuration, err)
+	}
+	p.err = err
+	p.stats.Errors++
+	p.retryAt = time.Now().Add(p.retryDuration)
+	if p.onError != nil {
+		p.postEvent(fileEvent{err: err}) // 不能在持有 p.mu 时回调，回调中可能调用 Stats Err Flush
+	}
+}
+
+// clearError 写入成功，退出失败状态，调用时需要持有 p.mu
+func (p *FileBackend) clearError() {
+	if p.err == nil {
+		return
+	}
+	internalLog("FileBackend: %s/%s recovered", p.dir, p.name)
+	p.err = nil
+}
+
+// retryDue 是否可以尝试打开或写入文件，失败后每 RetryInterval 重试一次，调用时需要持有 p.mu
+func (p *FileBackend) retryDue() bool {
+	return p.err == nil || !time.Now().Before(p.retryAt)
+}
+
+// fallback 文件写不进去并且 buffer 也满了，按 FallbackMode 处理b，b 中有 count 条日志，调用时需要持有 p.mu
+func (p *FileBackend) fallback(b []byte, count int) (int, error) {
+	if p.fallbackMode == FallbackStderr {
+		if _, err := os.Stderr.Write(b); err == nil {
+			p.stats.Fallback += uint64(count)
+			return 0, p.err
+		}
+	}
+	p.stats.Dropped += uint64(count)
+	return 0, p.err
+}
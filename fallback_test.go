@@ -0,0 +1,93 @@
+package dlog
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestOnErrorReentrant OnError 回调中调用 Stats Err 不会死锁，也不阻塞写日志
+func TestOnErrorReentrant(t *testing.T) {
+	parent := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(parent, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	var fb *FileBackend
+	ready := make(chan struct{})
+	fb, err := NewFileBackendWithConfig(filepath.Join(parent, "sub"), "error.log", FileBackendConfig{
+		RetryInterval: time.Millisecond,
+		Fallback:      FallbackDrop,
+		OnError: func(err error) {
+			<-ready
+			fb.Stats()
+			fb.Err()
+			atomic.AddInt32(&calls, 1)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(ready)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			fb.Write([]byte("line\n"))
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Write blocked by OnError")
+	}
+	fb.Close()
+	if atomic.LoadInt32(&calls) == 0 {
+		t.Error("OnError not called")
+	}
+	if fb.Stats().Errors == 0 {
+		t.Error("no errors recorded")
+	}
+}
+
+// TestWriteReturnsError 失败状态下 Write 返回错误，日志仍然放入 buffer 等待重试
+func TestWriteReturnsError(t *testing.T) {
+	parent := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(parent, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fb, err := NewFileBackendWithConfig(filepath.Join(parent, "sub"), "error.log", FileBackendConfig{Fallback: FallbackDrop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+	line := []byte("line\n")
+	n, err := fb.Write(line)
+	if err == nil {
+		t.Error("Write should return the open error")
+	}
+	if n != len(line) {
+		t.Errorf("n = %d, want %d buffered", n, len(line))
+	}
+}
+
+// TestWriteAfterClose Close 之后的写入返回错误，不会重新打开文件
+func TestWriteAfterClose(t *testing.T) {
+	dir := t.TempDir()
+	fb, err := NewFileBackendWithConfig(dir, "closed.log", FileBackendConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fb.Write([]byte("late\n")); err != errBackendClosed {
+		t.Errorf("Write after Close = %v, want %v", err, errBackendClosed)
+	}
+	if err := fb.Reopen(); err != errBackendClosed {
+		t.Errorf("Reopen after Close = %v, want %v", err, errBackendClosed)
+	}
+}
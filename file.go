@@ -1,130 +1,530 @@
 package dlog
 
 import (
-	"bufio"
-	"fmt"
+	"bytes"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
 	"sync"
 	"time"
+
+	"github.com/dajinkuang/errors"
 )
 
 const (
 	bufferSize    = 256 * 1024
 	flushDuration = time.Second * 5
+	fileFlag      = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	dirMode       = 0755
+	fileMode      = 0644
 )
 
 var _ io.WriteCloser = &FileBackend{}
+var _ LevelWriter = &FileBackend{}
+
+var errBackendClosed = errors.New("FileBackend_closed")
+
+// FileBackendConfig FileBackend 的配置，零值即默认配置
+type FileBackendConfig struct {
+	// Rotation 文件切分策略，为nil时按 RotateInterval 和 MaxSize 组合 TimeRotation SizeRotation
+	Rotation RotationPolicy
+	// MaxSize 单个文件的最大字节数，超过后在同一周期内切分出 .1 .2 ... 编号的文件，<=0 不限制
+	MaxSize int64
+	// RotateInterval 按时间切分的周期，比如 RotateDaily、10 * time.Minute，<=0 时为 RotateHourly
+	RotateInterval time.Duration
+	// FileNameTemplate 文件名模板，占位符见 formatFileName，为空时根据切分周期生成，小时切分时为 %N.%Y%m%d%H
+	FileNameTemplate string
+	// Clock 文件切分使用的时间来源，为nil时使用 SetClock 设置的
+	Clock Clock
+	// Retention 历史文件的保留策略，零值表示不清理
+	Retention RetentionConfig
+	// Compress 切分后历史文件的压缩格式，压缩后的文件名追加 .gz 或 .zst
+	Compress CompressFormat
+	// CompressWorkers 同时压缩的文件个数上限，<=0 时为1
+	CompressWorkers int
+	// CurrentLink 为true时维护一个指向当前文件的软链接 <name>.current，方便 tail -F
+	CurrentLink bool
+	// ReopenCheckInterval >0 时按这个间隔检查当前文件是否被外部 logrotate 移走或清空，是则重新打开
+	ReopenCheckInterval time.Duration
+	// ReopenOnSIGHUP 为true时收到 SIGHUP 重新打开当前文件，配合 logrotate 的 postrotate 使用
+	ReopenOnSIGHUP bool
+	// OnError 打开或写入文件失败时回调，失败期间每次重试失败也会回调
+	// 和 OnRotate OnClose 在同一个goroutine中依次执行，不阻塞写日志，回调中可以调用 Stats Err Flush
+	OnError func(err error)
+	// RetryInterval 失败后重试打开或写入文件的间隔，<=0 时为5秒，恢复后自动继续写文件
+	RetryInterval time.Duration
+	// Fallback 文件写不进去并且 buffer 也满了时新日志的去向，默认写到stderr
+	Fallback FallbackMode
+	// Durability 持久化方式，默认 DurabilityBuffered
+	Durability Durability
+	// BufferSize 缓存的字节数，<=0 时为256KB
+	BufferSize int
+	// FlushInterval 定期把缓存写入文件的间隔，<=0 时为5秒
+	FlushInterval time.Duration
+	// SyncInterval DurabilitySyncInterval 时fsync的间隔，<=0 时为1秒
+	SyncInterval time.Duration
+	// JournalPath 不为空时开启崩溃恢复缓冲，日志写入日志文件之前先拷贝到这个mmap文件中
+	// 进程崩溃(比如OOM被kill、panic)后下次启动时把没有写入日志文件的日志加上 "dlog_recovered":true 补写进来
+	// SetTopic 和路由的每个文件使用 JournalPath 加上 .<文件名> 后缀的崩溃恢复缓冲
+	JournalPath string
+	// JournalSize 崩溃恢复缓冲的大小，<=0 时为4MB，满了之后的日志不再记录
+	JournalSize int
+	// OnRotate 切分后回调，closedPath 是已经写入、fsync并关闭的文件，newPath 是新打开的文件
+	// 回调在单独的goroutine中依次执行，不阻塞写日志；开启 Compress 时回调返回后才压缩 closedPath
+	OnRotate func(closedPath, newPath string)
+	// OnClose Close 关闭文件后回调，Close 会等待所有回调执行完才返回
+	OnClose func(closedPath string)
+	// Header 不为nil时每个文件开头写入一条文件头日志，切分或关闭时写入一条文件尾日志，见 FileHeader
+	Header *FileHeader
+	// Index 时间索引，零值表示不生成，见 IndexConfig 和 ReadTimeRange，Shared 时不生成
+	Index IndexConfig
+	// Shared 为true时多个进程可以写同一个文件，buffer 按日志边界分批以 O_APPEND 整行写入，按文件实际大小切分
+	// 每个进程需要使用不同的 JournalPath，并且只应该有一个进程开启 Compress 和 Retention
+	Shared bool
+	// SharedLock Shared 时每次写入前加 flock 建议锁，和其它同样加锁的进程互斥
+	SharedLock bool
+	// DirMode 创建目录的权限，为0时为0755
+	DirMode os.FileMode
+	// FileMode 创建日志文件、索引等文件的权限，为0时为0644，比如 0640
+	FileMode os.FileMode
+	// DirLayout 按日期分的子目录模板，占位符同 FileNameTemplate，比如 "%Y/%m/%d" 时文件写入 dir/2024/01/15/
+	// 为空时直接写入 dir，目录在运行中被删除时会自动重新创建
+	DirLayout string
+}
 
 // FileBackend 日志文件读写
 type FileBackend struct {
-	mu            sync.Mutex
-	file          *os.File
-	buffer        *bufio.Writer
-	dir           string // directory for log files
-	name          string
-	filePath      string
-	lastCheck     uint64
-	flushDuration time.Duration
-	closeCh       chan struct{}
+	mu              sync.Mutex
+	file            *os.File // 打开失败时为nil
+	buf             []byte   // 还没有写入文件的数据，写入失败时保留，等待重试
+	bufSize         int
+	durability      Durability
+	syncDuration    time.Duration
+	journal         *journal // 崩溃恢复缓冲，为nil表示不开启
+	journalPending  []int64  // buffer 中的日志在崩溃恢复缓冲中的偏移
+	dir             string   // directory for log files
+	name            string
+	filePath        string  // 当前打开的文件
+	segment         Segment // 当前文件
+	size            int64   // 当前文件已写入的字节数，包括还在buffer中的
+	policy          RotationPolicy
+	clock           Clock // 为nil时使用 SetClock 设置的
+	template        string
+	layout          string // 子目录模板，为空表示直接写入 dir
+	dirMode         os.FileMode
+	fileMode        os.FileMode
+	pattern         *regexp.Regexp // 匹配该 FileBackend 生成的所有文件名
+	retention       RetentionConfig
+	retentionDir    *retentionDir // 所在目录，开启了 Retention 时按目录统计
+	rotateCh        chan struct{}
+	compress        CompressFormat
+	compressWorkers int
+	compressCh      chan struct{}
+	compressDone    chan struct{} // compressor 退出后关闭，为nil表示没有开启压缩
+	currentLink     string        // 指向当前文件的软链接，为空表示不维护
+	flushDuration   time.Duration
+	closeCh         chan struct{}
+	closed          bool      // Close 之后不再写入、打开文件
+	err             error     // 不为nil时处于失败状态
+	retryAt         time.Time // 失败状态下下一次重试的时间
+	retryDuration   time.Duration
+	onError         func(err error)
+	fallbackMode    FallbackMode
+	stats           FileBackendStats
+	header          *FileHeader
+	shared          bool
+	sharedLock      bool
+	indexCfg        IndexConfig
+	index           *os.File  // 当前文件的时间索引，为nil表示不生成
+	indexCount      int       // 上次记录索引之后写入的日志条数
+	indexAt         time.Time // 上次记录索引的时间
+	entries         int64     // 当前文件从文件头开始写入的日志条数
+	written         int64     // 当前文件从文件头开始写入的字节数
+	onRotate        func(closedPath, newPath string)
+	onClose         func(closedPath string)
+	eventMu         sync.Mutex
+	events          []fileEvent     // 还没有执行回调的事件
+	rotating        map[string]bool // OnRotate 回调还没有执行完的文件，compressor 和 janitor 跳过这些文件
+	eventsClosed    bool            // Close 之后不再有新的事件
+	eventCh         chan struct{}   // 通知 notifier 有新的事件
+	eventDone       chan struct{}   // notifier 执行完所有事件退出，为nil表示没有设置回调
 }
 
 // Write 写操作
+// 文件写不进去时数据先留在 buffer 中等待重试，这时返回的n为放入 buffer 的字节数，同时返回当前的错误
+// buffer 也满了才按 Fallback 处理，n 为0
 func (p *FileBackend) Write(b []byte) (n int, err error) {
-	p.mustFileExist()
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	return p.buffer.Write(b)
+	return p.WriteLevel(0, b)
+}
+
+// write 把一条日志放入 buffer，每条日志单独判断切分和记录索引，off 为日志在崩溃恢复缓冲中的偏移
+// 处于失败状态时日志仍然放入 buffer 等待重试，同时返回 p.err，调用时需要持有 p.mu
+func (p *FileBackend) write(b []byte, off int64) (n int, err error) {
+	p.rotate(len(b))
+	if len(p.buf)+len(b) > p.bufSize {
+		p.flush()
+	}
+	if len(p.buf) > 0 && len(p.buf)+len(b) > p.bufSize {
+		p.journalDone(off)
+		return p.fallback(b, 1)
+	}
+	p.addIndex(p.size)
+	p.buf = append(p.buf, b...)
+	p.size += int64(len(b))
+	p.entries++
+	p.written += int64(len(b))
+	if off != noJournal {
+		p.journalPending = append(p.journalPending, off)
+	}
+	return len(b), p.err
 }
 
 // Flush 刷到磁盘
 func (p *FileBackend) Flush() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	return p.buffer.Flush()
+	return p.flush()
+}
+
+// flush 把 buffer 写入文件，没写进去的部分留在 buffer 中，失败状态下每 RetryInterval 才真正重试一次
+// 调用时需要持有 p.mu
+func (p *FileBackend) flush() error {
+	if p.closed {
+		return errBackendClosed
+	}
+	if !p.retryDue() {
+		return p.err
+	}
+	if p.file == nil {
+		p.rotate(0)
+		if p.file == nil {
+			return p.err
+		}
+	}
+	var n int
+	var err error
+	if p.shared {
+		n, err = p.writeShared()
+	} else {
+		n, err = p.file.Write(p.buf)
+	}
+	p.buf = p.buf[:copy(p.buf, p.buf[n:])]
+	if err != nil {
+		p.setError(err)
+		return err
+	}
+	p.journalFlushed()
+	p.clearError()
+	return nil
 }
 
-// Close 关闭文件读写
+// Close 关闭文件读写，最后仍然写不进去的数据按 Fallback 处理
+// 等待正在压缩的文件压缩完，还没开始压缩的留到下次启动
 func (p *FileBackend) Close() error {
 	close(p.closeCh)
+	if p.retentionDir != nil {
+		p.unregisterRetention()
+	}
+	closedPath, err := p.closeFile()
+	p.closeEvents(closedPath)
+	if p.compressDone != nil {
+		<-p.compressDone
+	}
+	return err
+}
+
+// closeFile 写入 buffer 并关闭文件，返回关闭的文件，没有打开的文件时为空
+func (p *FileBackend) closeFile() (closedPath string, err error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.buffer.Flush()
+	p.retryAt = time.Time{}
+	if p.file != nil {
+		p.writeFooter("")
+	}
+	err = p.flush()
+	p.closed = true
+	if len(p.buf) > 0 {
+		p.fallback(p.buf, bytes.Count(p.buf, []byte{'\n'}))
+		p.buf = nil
+		p.journalFlushed()
+	}
+	if p.journal != nil {
+		p.journal.close()
+	}
+	p.closeIndex()
+	if p.file == nil {
+		return "", err
+	}
 	p.file.Sync()
-	return p.file.Close()
-}
-
-func (p *FileBackend) monitorFiles() {
-	p.lastCheck = getLastCheck(time.Now())
-	for range time.NewTicker(time.Second * 5).C {
-		fileName := path.Join(p.dir, p.name)
-		check := getLastCheck(time.Now())
-		if p.lastCheck >= check {
-			continue
-		}
-		p.mu.Lock()
-		os.Rename(fileName, fileName+fmt.Sprintf(".%d", p.lastCheck))
-		p.lastCheck = check
-		newFile, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			panic(err)
-		}
-		p.buffer.Flush()
-		p.file.Close()
-		p.file = newFile
-		p.buffer.Reset(p.file)
-		p.mu.Unlock()
+	if closeErr := p.file.Close(); closeErr != nil {
+		return p.filePath, closeErr
 	}
-}
-
-func getLastCheck(now time.Time) uint64 {
-	return uint64(now.Year())*1000000 + uint64(now.Month())*10000 + uint64(now.Day())*100 + uint64(now.Hour())
+	return p.filePath, err
 }
 
 func (p *FileBackend) flushFile() {
 	ticker := time.NewTicker(p.flushDuration)
+	defer ticker.Stop()
+	var syncTick <-chan time.Time
+	if p.durability == DurabilitySyncInterval {
+		syncTicker := time.NewTicker(p.syncDuration)
+		defer syncTicker.Stop()
+		syncTick = syncTicker.C
+	}
 	for {
 		select {
 		case <-ticker.C:
+			p.reopenIfDeleted()
 			p.Flush()
+		case <-syncTick:
+			p.Sync()
 		case <-p.closeCh:
 			return
 		}
 	}
 }
 
-func (p *FileBackend) mustFileExist() {
-	timeStr := time.Now().Format(".2006010215")
-	filePath := path.Join(p.dir, p.name+timeStr)
-	if filePath == p.filePath {
+// rotate 按 RotationPolicy 确保当前打开的是该写入的文件，n 为接下来要写入的字节数，调用时需要持有 p.mu
+// 打开新文件失败时继续使用之前的文件，每 RetryInterval 重试一次
+func (p *FileBackend) rotate(n int) {
+	t := p.now()
+	seg := p.policy.Next(t, RotationState{Segment: p.segment, Size: p.size}, n)
+	if p.file != nil && seg.Equal(p.segment) {
 		return
 	}
-	p.mu.Lock()
-	newFile, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if !p.retryDue() {
+		return
+	}
+	var size int64
+	if p.file == nil || !seg.Period.Equal(p.segment.Period) {
+		// 新的周期接着已有的文件写，比如进程重启，写满了由策略决定下一个
+		seg, size = p.lastSegment(seg)
+		if next := p.policy.Next(t, RotationState{Segment: seg, Size: size}, n); !next.Equal(seg) {
+			seg, size = next, 0
+		}
+	}
+	if err := p.openFile(p.segmentPath(seg)); err != nil {
+		p.setError(err)
+		return
+	}
+	p.segment, p.size = seg, size+int64(len(p.buf))
+	p.writeHeader()
+}
+
+// now FileBackend 使用的当前时间
+func (p *FileBackend) now() time.Time {
+	if p.clock == nil {
+		return now()
+	}
+	return nowFrom(p.clock)
+}
+
+// lastSegment 找到seg所在周期已有的最后一个文件及其大小，最后一个已经被压缩时返回下一个编号
+func (p *FileBackend) lastSegment(seg Segment) (Segment, int64) {
+	for segmentExists(p.segmentPath(Segment{Period: seg.Period, Seq: seg.Seq + 1})) {
+		seg.Seq++
+	}
+	info, err := os.Stat(p.segmentPath(seg))
+	if err == nil {
+		return seg, info.Size()
+	}
+	if segmentExists(p.segmentPath(seg)) {
+		seg.Seq++ // 已经被压缩，不能再追加
+	}
+	return seg, 0
+}
+
+// openFile 打开filePath，成功后刷新并关闭之前的文件，调用时需要持有 p.mu
+func (p *FileBackend) openFile(filePath string) error {
+	newFile, err := p.openLogFile(filePath, fileFlag)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if p.file != nil {
+		p.writeFooter(filePath)
+		p.flush()
+		p.file.Sync()
+		p.file.Close()
+		p.notifyRotate()
+		if p.eventDone != nil {
+			p.postEvent(fileEvent{closedPath: p.filePath, newPath: filePath})
+		}
 	}
-	p.buffer.Flush()
-	p.file.Close()
 	p.file = newFile
-	p.buffer.Reset(p.file)
 	p.filePath = filePath
-	p.mu.Unlock()
+	p.openIndex(false)
+	p.updateCurrentLink()
+	return nil
 }
 
-// NewFileBackend 新建一个FileBackend
-func NewFileBackend(dir, name string) (*FileBackend, error) {
-	if err := os.MkdirAll(dir, 0755); err != nil {
+// openLogFile 按 FileMode 打开文件，所在目录不存在(比如被删除了)时按 DirMode 创建目录
+func (p *FileBackend) openLogFile(filePath string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(filePath, flag, p.fileMode)
+	if err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+	if err = os.MkdirAll(path.Dir(filePath), p.dirMode); err != nil {
 		return nil, err
 	}
+	return os.OpenFile(filePath, flag, p.fileMode)
+}
+
+// updateCurrentLink 把软链接指向当前文件，先建临时软链接再 rename 覆盖，调用时需要持有 p.mu
+func (p *FileBackend) updateCurrentLink() {
+	if len(p.currentLink) <= 0 {
+		return
+	}
+	tmp := p.currentLink + ".tmp"
+	os.Remove(tmp)
+	target, err := filepath.Rel(p.dir, p.filePath)
+	if err != nil {
+		target = p.filePath
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		internalLog("FileBackend: symlink %s failed: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, p.currentLink); err != nil {
+		os.Remove(tmp)
+		internalLog("FileBackend: rename %s failed: %v", tmp, err)
+	}
+}
+
+// segmentExists 文件或者其压缩后的文件是否存在
+func segmentExists(filePath string) bool {
+	if _, err := os.Stat(filePath); err == nil {
+		return true
+	}
+	for _, suffix := range compressSuffixes {
+		if _, err := os.Stat(filePath + suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// segmentPath 文件路径，比如 topic.log_json_std.2024010215.1
+func (p *FileBackend) segmentPath(seg Segment) string {
+	return path.Join(p.dir, formatFileName(p.layout, p.name, seg.Period, 0), formatFileName(p.template, p.name, seg.Period, seg.Seq))
+}
+
+// NewFileBackend 新建一个FileBackend，使用 SetFileBackendConfig 设置的配置
+func NewFileBackend(dir, name string) (*FileBackend, error) {
+	return NewFileBackendWithConfig(dir, name, _fileBackendConfig)
+}
+
+// NewFileBackendWithConfig 按配置新建一个FileBackend
+// 目录或文件暂时无法创建时不返回错误，按 OnError 和 Fallback 处理，之后每 RetryInterval 自动重试
+func NewFileBackendWithConfig(dir, name string, cfg FileBackendConfig) (*FileBackend, error) {
 	fb := new(FileBackend)
 	fb.dir = dir
 	fb.name = name
-	fb.buffer = bufio.NewWriterSize(fb.file, bufferSize)
-	fb.flushDuration = flushDuration
+	fb.policy = cfg.rotationPolicy()
+	fb.clock = cfg.Clock
+	fb.template = cfg.fileNameTemplate(fb.policy)
+	fb.layout = cfg.DirLayout
+	fb.dirMode = cfg.DirMode
+	if fb.dirMode == 0 {
+		fb.dirMode = dirMode
+	}
+	fb.fileMode = cfg.FileMode
+	if fb.fileMode == 0 {
+		fb.fileMode = fileMode
+	}
+	fb.pattern = fileNamePattern(fb.template, fb.name)
+	fb.retention = cfg.Retention
+	if cfg.CurrentLink {
+		fb.currentLink = path.Join(dir, name+".current")
+	}
+	fb.compress = cfg.Compress
+	fb.compressWorkers = cfg.CompressWorkers
+	if fb.compressWorkers <= 0 {
+		fb.compressWorkers = 1
+	}
+	fb.bufSize = cfg.BufferSize
+	if fb.bufSize <= 0 {
+		fb.bufSize = bufferSize
+	}
+	fb.flushDuration = cfg.FlushInterval
+	if fb.flushDuration <= 0 {
+		fb.flushDuration = flushDuration
+	}
+	fb.durability = cfg.Durability
+	fb.syncDuration = cfg.SyncInterval
+	if fb.syncDuration <= 0 {
+		fb.syncDuration = syncDuration
+	}
 	fb.closeCh = make(chan struct{})
-	fb.mustFileExist()
+	fb.onError = cfg.OnError
+	fb.retryDuration = cfg.RetryInterval
+	if fb.retryDuration <= 0 {
+		fb.retryDuration = retryDuration
+	}
+	fb.fallbackMode = cfg.Fallback
+	fb.header = cfg.Header
+	fb.indexCfg = cfg.Index
+	if cfg.Shared {
+		// 其它进程在 flush 之前也会追加，放入 buffer 时记录的偏移不是日志在文件中的实际位置
+		fb.indexCfg = IndexConfig{}
+	}
+	fb.shared = cfg.Shared
+	fb.sharedLock = cfg.Shared && cfg.SharedLock
+	fb.onRotate = cfg.OnRotate
+	fb.onClose = cfg.OnClose
+	if fb.onRotate != nil || fb.onClose != nil || fb.onError != nil {
+		fb.eventCh = make(chan struct{}, 1)
+		fb.rotating = make(map[string]bool)
+		fb.eventDone = make(chan struct{})
+		go fb.notifier()
+	}
+	fb.mu.Lock()
+	fb.rotate(0)
+	fb.mu.Unlock()
+	if len(cfg.JournalPath) > 0 {
+		fb.recoverJournal(cfg.JournalPath, cfg.JournalSize)
+	}
 	go fb.flushFile()
+	if fb.retention.enabled() {
+		fb.rotateCh = make(chan struct{}, 1)
+		fb.registerRetention()
+		go fb.janitor()
+	}
+	if fb.compress != CompressNone {
+		fb.compressCh = make(chan struct{}, 1)
+		fb.compressDone = make(chan struct{})
+		go fb.compressor()
+	}
+	if cfg.ReopenCheckInterval > 0 || cfg.ReopenOnSIGHUP {
+		go fb.watchReopen(cfg.ReopenCheckInterval, cfg.ReopenOnSIGHUP)
+	}
 	return fb, nil
 }
+
+// rotationPolicy 配置的切分策略，没有设置 Rotation 时按 RotateInterval 和 MaxSize 组合
+func (cfg FileBackendConfig) rotationPolicy() RotationPolicy {
+	if cfg.Rotation != nil {
+		return cfg.Rotation
+	}
+	var policy RotationPolicy = TimeRotation{Interval: cfg.RotateInterval}
+	if cfg.MaxSize > 0 {
+		policy = CombinedRotation{policy, SizeRotation{MaxSize: cfg.MaxSize}}
+	}
+	return policy
+}
+
+// fileNameTemplate 配置的文件名模板，没有设置时根据切分周期生成
+func (cfg FileBackendConfig) fileNameTemplate(policy RotationPolicy) string {
+	if len(cfg.FileNameTemplate) > 0 {
+		return cfg.FileNameTemplate
+	}
+	return defaultFileNameTemplate(rotationInterval(policy))
+}
+
+var _fileBackendConfig FileBackendConfig
+
+// SetFileBackendConfig 设置 NewFileBackend 和 SetTopic 使用的默认配置，需要在 SetTopic 之前调用
+func SetFileBackendConfig(cfg FileBackendConfig) {
+	_fileBackendConfig = cfg
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package dlog
+
+import (
+	"os"
+)
+
+// lockFile 当前平台不支持 flock，只依赖 O_APPEND
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile 当前平台不支持 flock
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package dlog
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile 加排他的建议锁，等到其它进程释放为止
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// unlockFile 释放建议锁
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,66 @@
+package dlog
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// headerSchemaVersion 文件头、文件尾日志的格式版本，字段变化时加1
+const headerSchemaVersion = 1
+
+// _startTime 进程启动时间
+var _startTime = time.Now()
+
+// FileHeader 文件头日志的内容，每个文件打开时写入一条 "dlog_header":true 的日志
+// 切分或关闭时写入一条 "dlog_footer":true 的日志，带上本次写入的日志条数和字节数，用于发现被截断或没写完的文件
+type FileHeader struct {
+	Service string // 服务名
+	Version string // 程序版本
+}
+
+// writeHeader 在新打开的文件中写入文件头，调用时需要持有 p.mu
+func (p *FileBackend) writeHeader() {
+	p.entries, p.written = 0, 0
+	if p.header == nil {
+		return
+	}
+	host, _ := os.Hostname()
+	e := newLogEntry()
+	e.set("dlog_header", true)
+	e.set("service", p.header.Service)
+	e.set("version", p.header.Version)
+	e.set("host", host)
+	e.set("pid", os.Getpid())
+	e.set("start_time", formatTime(_startTime))
+	e.set("cur_time", formatTime(p.now()))
+	e.set("schema_version", headerSchemaVersion)
+	p.appendMarker(append(e.encode(), '\n'))
+}
+
+// writeFooter 在要关闭的文件中写入文件尾，nextPath 为切分后的新文件，关闭时为空，调用时需要持有 p.mu
+func (p *FileBackend) writeFooter(nextPath string) {
+	if p.header == nil {
+		return
+	}
+	e := newLogEntry()
+	e.set("dlog_footer", true)
+	if len(nextPath) > 0 {
+		e.set("reason", "rotate")
+		e.set("next_file", path.Base(nextPath))
+	} else {
+		e.set("reason", "close")
+	}
+	e.set("cur_time", formatTime(p.now()))
+	e.set("entries", p.entries) // 文件头之后写入的日志条数
+	e.set("bytes", p.written)   // 文件头开始写入的字节数，不包括文件尾
+	e.set("schema_version", headerSchemaVersion)
+	p.appendMarker(append(e.encode(), '\n'))
+}
+
+// appendMarker 把文件头或文件尾放入 buffer，不计入日志条数，调用时需要持有 p.mu
+func (p *FileBackend) appendMarker(b []byte) {
+	p.buf = append(p.buf, b...)
+	p.size += int64(len(b))
+	p.written += int64(len(b))
+}
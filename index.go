@@ -0,0 +1,269 @@
+package dlog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 时间索引文件 <日志文件>.idx 的格式，每条记录为 unix纳秒(8) | 日志在文件中的偏移(8)，小端
+const (
+	indexSuffix     = ".idx"
+	indexRecordSize = 16
+)
+
+// IndexConfig 时间索引的配置，零值表示不生成索引
+// 每个日志文件旁边生成一个 <日志文件>.idx，记录写入时间到文件偏移的稀疏索引，ReadTimeRange 用它跳到要读的位置
+type IndexConfig struct {
+	Every    int           // 每写入多少条日志记录一次，<=0 表示不按条数
+	Interval time.Duration // 距上次记录超过这个时间后记录一次，<=0 表示不按时间
+}
+
+// enabled 是否生成索引
+func (c IndexConfig) enabled() bool {
+	return c.Every > 0 || c.Interval > 0
+}
+
+// indexPath 日志文件对应的索引文件，压缩后的日志文件使用压缩前的索引文件
+func indexPath(filePath string) string {
+	for _, suffix := range compressSuffixes {
+		filePath = strings.TrimSuffix(filePath, suffix)
+	}
+	return filePath + indexSuffix
+}
+
+// openIndex 打开当前日志文件的索引文件，truncate 为true时清空已有的记录，调用时需要持有 p.mu
+func (p *FileBackend) openIndex(truncate bool) {
+	if !p.indexCfg.enabled() {
+		return
+	}
+	p.closeIndex()
+	flag := fileFlag
+	if truncate {
+		flag |= os.O_TRUNC
+	}
+	f, err := p.openLogFile(indexPath(p.filePath), flag)
+	if err != nil {
+		internalLog("FileBackend: open index %s failed: %v", indexPath(p.filePath), err)
+		return
+	}
+	p.index = f
+	p.indexCount, p.indexAt = 0, time.Time{}
+}
+
+// closeIndex 关闭索引文件，调用时需要持有 p.mu
+func (p *FileBackend) closeIndex() {
+	if p.index != nil {
+		p.index.Close()
+		p.index = nil
+	}
+}
+
+// addIndex 在写入偏移为off的日志之前按 IndexConfig 记录索引，每个文件的第一条日志总是记录，调用时需要持有 p.mu
+func (p *FileBackend) addIndex(off int64) {
+	if p.index == nil {
+		return
+	}
+	var t time.Time
+	record := p.indexAt.IsZero() || (p.indexCfg.Every > 0 && p.indexCount >= p.indexCfg.Every)
+	if record || p.indexCfg.Interval > 0 {
+		t = p.now()
+		record = record || (p.indexCfg.Interval > 0 && t.Sub(p.indexAt) >= p.indexCfg.Interval)
+	}
+	p.indexCount++
+	if !record {
+		return
+	}
+	b := make([]byte, indexRecordSize)
+	binary.LittleEndian.PutUint64(b, uint64(t.UnixNano()))
+	binary.LittleEndian.PutUint64(b[8:], uint64(off))
+	if _, err := p.index.Write(b); err != nil {
+		internalLog("FileBackend: write index %s failed: %v", p.index.Name(), err)
+		p.closeIndex()
+		return
+	}
+	p.indexCount, p.indexAt = 1, t
+}
+
+// indexRecord 索引中的一条记录
+type indexRecord struct {
+	t   time.Time
+	off int64
+}
+
+// readIndex 读取日志文件的索引，没有索引文件时返回nil
+func readIndex(filePath string) []indexRecord {
+	b, err := os.ReadFile(indexPath(filePath))
+	if err != nil {
+		return nil
+	}
+	records := make([]indexRecord, 0, len(b)/indexRecordSize)
+	for ; len(b) >= indexRecordSize; b = b[indexRecordSize:] {
+		records = append(records, indexRecord{
+			t:   time.Unix(0, int64(binary.LittleEndian.Uint64(b))),
+			off: int64(binary.LittleEndian.Uint64(b[8:])),
+		})
+	}
+	return records
+}
+
+// ReadTimeRange 读取 dir 下 name 的所有日志文件(包括切分和压缩后的)中 [start, end) 时间范围内写入的日志
+// cfg 需要和写日志时的 FileBackendConfig 一致，用来匹配文件名
+// 有索引的文件直接跳到索引记录的位置，返回的日志按索引的粒度对齐，前后可能多出不超过一个索引间隔的日志
+// 没有索引的文件整个返回，修改时间早于 start 的文件跳过，文件按第一条索引的时间排序
+func ReadTimeRange(dir, name string, cfg FileBackendConfig, start, end time.Time) (io.ReadCloser, error) {
+	policy := cfg.rotationPolicy()
+	files, err := listLogFiles(dir, fileNamePattern(cfg.fileNameTemplate(policy), name), len(cfg.DirLayout) > 0)
+	if err != nil {
+		return nil, err
+	}
+	// 按第一条索引的时间排序，没有索引的文件按修改时间
+	type indexedFile struct {
+		logFile
+		records []indexRecord
+		first   time.Time
+	}
+	indexed := make([]indexedFile, 0, len(files))
+	for _, f := range files {
+		ifile := indexedFile{logFile: f, records: readIndex(f.path), first: f.modTime}
+		if len(ifile.records) > 0 {
+			ifile.first = ifile.records[0].t
+		}
+		indexed = append(indexed, ifile)
+	}
+	sort.Slice(indexed, func(i, j int) bool {
+		return indexed[i].first.Before(indexed[j].first)
+	})
+	r := new(rangeReader)
+	for k, f := range indexed {
+		if f.modTime.Before(start) {
+			continue
+		}
+		if k+1 < len(indexed) && len(indexed[k+1].records) > 0 && !indexed[k+1].first.After(start) {
+			continue // 下一个文件开始写入时还没到 start
+		}
+		seg := rangeSegment{path: f.path, from: 0, to: -1}
+		if records := f.records; len(records) > 0 {
+			if !records[0].t.Before(end) {
+				continue
+			}
+			// 最后一条写入时间不晚于 start 的记录开始，第一条写入时间不早于 end 的记录结束
+			i := sort.Search(len(records), func(i int) bool { return records[i].t.After(start) })
+			if i > 0 {
+				seg.from = records[i-1].off
+			}
+			if j := sort.Search(len(records), func(i int) bool { return !records[i].t.Before(end) }); j < len(records) {
+				seg.to = records[j].off
+			}
+		}
+		if seg.to >= 0 && seg.to <= seg.from {
+			continue
+		}
+		r.segments = append(r.segments, seg)
+	}
+	return r, nil
+}
+
+// rangeSegment 要读取的一个日志文件中 [from, to) 的部分，to 为-1表示读到文件末尾
+type rangeSegment struct {
+	path     string
+	from, to int64
+}
+
+// rangeReader 依次读取多个日志文件的一部分
+type rangeReader struct {
+	segments []rangeSegment
+	cur      io.Reader
+	closers  []io.Closer
+}
+
+// Read 读取当前文件，读完后打开下一个
+func (r *rangeReader) Read(b []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.segments) <= 0 {
+				return 0, io.EOF
+			}
+			if err := r.open(r.segments[0]); err != nil {
+				return 0, err
+			}
+			r.segments = r.segments[1:]
+		}
+		n, err := r.cur.Read(b)
+		if err == io.EOF {
+			r.closeCurrent()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// open 打开日志文件并跳到 seg.from，压缩的文件解压后跳过前面的部分
+func (r *rangeReader) open(seg rangeSegment) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	r.closers = append(r.closers, f)
+	var rd io.Reader = f
+	switch {
+	case strings.HasSuffix(seg.path, CompressGzip.suffix()):
+		zr, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			r.closeCurrent()
+			return err
+		}
+		r.closers = append(r.closers, zr)
+		rd = zr
+	case strings.HasSuffix(seg.path, CompressZstd.suffix()):
+		zr, err := zstd.NewReader(bufio.NewReader(f))
+		if err != nil {
+			r.closeCurrent()
+			return err
+		}
+		r.closers = append(r.closers, zr.IOReadCloser())
+		rd = zr
+	}
+	if seg.from > 0 {
+		if rd == io.Reader(f) {
+			_, err = f.Seek(seg.from, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, rd, seg.from)
+		}
+		if err != nil {
+			r.closeCurrent()
+			return err
+		}
+	}
+	if seg.to >= 0 {
+		rd = io.LimitReader(rd, seg.to-seg.from)
+	}
+	r.cur = rd
+	return nil
+}
+
+// closeCurrent 关闭当前文件
+func (r *rangeReader) closeCurrent() {
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		r.closers[i].Close()
+	}
+	r.closers = nil
+	r.cur = nil
+}
+
+// Close 关闭当前文件，不再读取后面的文件
+func (r *rangeReader) Close() error {
+	r.closeCurrent()
+	r.segments = nil
+	return nil
+}
@@ -0,0 +1,143 @@
+package dlog
+
+import (
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock 测试用的时间来源，只在调用 Add 时前进
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// writeNumbered 每秒写入一条内容为序号的日志
+func writeNumbered(t *testing.T, fb *FileBackend, clock *fakeClock, from, to int) {
+	for i := from; i < to; i++ {
+		if _, err := fb.Write([]byte(strconv.Itoa(i) + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		clock.Add(time.Second)
+	}
+}
+
+// readNumbered 读取 [start, end) 时间范围内的日志序号
+func readNumbered(t *testing.T, dir, name string, cfg FileBackendConfig, start, end time.Time) []int {
+	r, err := ReadTimeRange(dir, name, cfg, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret []int
+	for _, line := range strings.Fields(string(b)) {
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			t.Fatalf("unexpected line %q", line)
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+// equalInts 两个序号列表是否相同
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestReopenKeepsIndex 路径还指向同一个文件时 Reopen 不清空索引，之前的日志仍然能按时间读到
+func TestReopenKeepsIndex(t *testing.T) {
+	dir := t.TempDir()
+	t0 := time.Date(2024, 1, 15, 10, 0, 0, 0, time.Local)
+	clock := &fakeClock{t: t0}
+	cfg := FileBackendConfig{Clock: clock, Index: IndexConfig{Every: 1}}
+	fb, err := NewFileBackendWithConfig(dir, "reopen.log", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeNumbered(t, fb, clock, 0, 10)
+	if err := fb.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	writeNumbered(t, fb, clock, 10, 20)
+	if err := fb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		from, to int
+		want     []int
+	}{
+		{2, 5, []int{2, 3, 4}},
+		{8, 12, []int{8, 9, 10, 11}},
+		{15, 30, []int{15, 16, 17, 18, 19}},
+	} {
+		got := readNumbered(t, dir, "reopen.log", cfg, t0.Add(time.Duration(tc.from)*time.Second), t0.Add(time.Duration(tc.to)*time.Second))
+		if !equalInts(got, tc.want) {
+			t.Errorf("range [%d, %d) = %v, want %v", tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+// TestReadTimeRangeAcrossSegments 时间范围跨过切分和压缩后的文件
+func TestReadTimeRangeAcrossSegments(t *testing.T) {
+	for _, format := range []CompressFormat{CompressGzip, CompressZstd} {
+		dir := t.TempDir()
+		t0 := time.Date(2024, 1, 15, 10, 59, 50, 0, time.Local)
+		clock := &fakeClock{t: t0}
+		cfg := FileBackendConfig{Clock: clock, Index: IndexConfig{Every: 2}}
+		fb, err := NewFileBackendWithConfig(dir, "range.log", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeNumbered(t, fb, clock, 0, 30) // 0-9 在10点的文件，10-29 在11点的文件
+		if err := fb.Close(); err != nil {
+			t.Fatal(err)
+		}
+		first := filepath.Join(dir, "range.log.2024011510")
+		if err := compressFile(first, format); err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			from, to int
+			want     []int
+		}{
+			{4, 8, []int{4, 5, 6, 7}},                  // 只在压缩的文件中
+			{6, 14, []int{6, 7, 8, 9, 10, 11, 12, 13}}, // 跨两个文件
+			{12, 16, []int{12, 13, 14, 15}},            // 只在第二个文件中
+			{-10, 4, []int{0, 1, 2, 3}},                // 从第一条之前开始
+		} {
+			got := readNumbered(t, dir, "range.log", cfg, t0.Add(time.Duration(tc.from)*time.Second), t0.Add(time.Duration(tc.to)*time.Second))
+			if !equalInts(got, tc.want) {
+				t.Errorf("%s range [%d, %d) = %v, want %v", format.suffix(), tc.from, tc.to, got, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package dlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sync"
+
+	"github.com/dajinkuang/errors"
+)
+
+// journalSize 崩溃恢复缓冲默认的数据区大小
+const journalSize = 4 * 1024 * 1024
+
+// 崩溃恢复缓冲文件的格式:
+//
+//	header: magic(8) | capacity(8) | head(8) | tail(8)
+//	data:   capacity 字节的环形区域，记录为 length(4) | state(1) | data
+//
+// head tail 是只增不减的逻辑偏移，对 capacity 取模得到在数据区中的位置
+// 记录写完后才更新 head，进程在写的过程中崩溃时这条不完整的记录不会被恢复
+const (
+	journalMagic      = "DLOGRING"
+	journalHeaderSize = 32
+	journalRecordHead = 5
+
+	journalPending byte = 0 // 还没有写入日志文件
+	journalDone    byte = 1 // 已经写入日志文件
+)
+
+// noJournal 没有记录到崩溃恢复缓冲，比如缓冲满了
+const noJournal int64 = -1
+
+// journal mmap 的环形缓冲，日志在确认写入前先拷贝进来，进程崩溃后还在page cache中，下次启动时恢复
+type journal struct {
+	mu       sync.Mutex
+	file     *os.File
+	data     []byte // mmap 的整个文件
+	capacity uint64
+	head     uint64
+	tail     uint64
+	skipped  uint64 // 缓冲满了没有记录的条数
+	closed   bool   // close 之后 data 已经解除mmap，不能再访问
+}
+
+// openJournal 打开或创建崩溃恢复缓冲文件，返回上次没有写入日志文件的记录
+func openJournal(filePath string, capacity int, mode os.FileMode) (j *journal, pending [][]byte, err error) {
+	if capacity <= 0 {
+		capacity = journalSize
+	}
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := int64(journalHeaderSize + capacity)
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.Size() != size {
+		// 大小不同时旧的数据无法解析，只能丢弃
+		if err = f.Truncate(0); err == nil {
+			err = f.Truncate(size)
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	data, err := mmapFile(f, int(size))
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	j = &journal{file: f, data: data, capacity: uint64(capacity)}
+	if string(data[:8]) == journalMagic && binary.LittleEndian.Uint64(data[8:]) == j.capacity {
+		j.head = binary.LittleEndian.Uint64(data[16:])
+		j.tail = binary.LittleEndian.Uint64(data[24:])
+		pending = j.pendingRecords()
+	}
+	j.head, j.tail = 0, 0
+	copy(data, journalMagic)
+	binary.LittleEndian.PutUint64(data[8:], j.capacity)
+	j.writeHeader()
+	return j, pending, nil
+}
+
+// pendingRecords tail 到 head 之间还没有写入日志文件的记录
+func (j *journal) pendingRecords() (pending [][]byte) {
+	if j.head < j.tail || j.head-j.tail > j.capacity {
+		return nil
+	}
+	for off := j.tail; off < j.head; {
+		head := j.read(off, journalRecordHead)
+		n := uint64(binary.LittleEndian.Uint32(head))
+		if off+journalRecordHead+n > j.head {
+			break
+		}
+		if head[4] == journalPending {
+			pending = append(pending, j.read(off+journalRecordHead, n))
+		}
+		off += journalRecordHead + n
+	}
+	return pending
+}
+
+// append 记录一条日志，返回记录的偏移，缓冲满了或者已经关闭时返回 noJournal
+func (j *journal) append(b []byte) int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return noJournal
+	}
+	need := uint64(journalRecordHead + len(b))
+	if j.head-j.tail+need > j.capacity {
+		j.skipped++
+		return noJournal
+	}
+	off := j.head
+	head := make([]byte, journalRecordHead)
+	binary.LittleEndian.PutUint32(head, uint32(len(b)))
+	head[4] = journalPending
+	j.write(off, head)
+	j.write(off+journalRecordHead, b)
+	j.head += need
+	j.writeHeader()
+	return int64(off)
+}
+
+// done 标记偏移为off的记录已经写入日志文件，并释放 tail 开始连续已完成的记录
+func (j *journal) done(off int64) {
+	if off == noJournal {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return
+	}
+	j.write(uint64(off)+4, []byte{journalDone})
+	for j.tail < j.head {
+		head := j.read(j.tail, journalRecordHead)
+		if head[4] != journalDone {
+			break
+		}
+		j.tail += journalRecordHead + uint64(binary.LittleEndian.Uint32(head))
+	}
+	j.writeHeader()
+}
+
+// close 解除mmap并关闭文件，之后的 append done 不再访问 data
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	err := munmapFile(j.data)
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (j *journal) writeHeader() {
+	binary.LittleEndian.PutUint64(j.data[16:], j.head)
+	binary.LittleEndian.PutUint64(j.data[24:], j.tail)
+}
+
+// write 在逻辑偏移off处写入b，超过数据区末尾时回到开头
+func (j *journal) write(off uint64, b []byte) {
+	region := j.data[journalHeaderSize:]
+	pos := off % j.capacity
+	n := copy(region[pos:], b)
+	copy(region, b[n:])
+}
+
+// read 读取逻辑偏移off处的n个字节
+func (j *journal) read(off, n uint64) []byte {
+	region := j.data[journalHeaderSize:]
+	ret := make([]byte, n)
+	pos := off % j.capacity
+	m := copy(ret, region[pos:])
+	copy(ret[m:], region)
+	return ret
+}
+
+// markRecovered 给恢复的日志加上标记，json日志加上 "dlog_recovered":true 字段，其它的加上前缀
+func markRecovered(b []byte) []byte {
+	b = bytes.TrimRight(b, "\n")
+	if len(b) >= 2 && b[0] == '{' {
+		rest := bytes.TrimSpace(b[1:])
+		if len(rest) > 0 && rest[0] == '}' {
+			return append([]byte(`{"dlog_recovered":true`), append(rest, '\n')...)
+		}
+		return append([]byte(`{"dlog_recovered":true,`), append(rest, '\n')...)
+	}
+	return append([]byte("[dlog_recovered] "), append(b, '\n')...)
+}
+
+// journalWriter 支持崩溃恢复缓冲的writer，dLogWriter 在放入队列之前先调用 journalAppend 记录下来
+// writeJournaled 的b可以是多条日志，ends 为每条日志在b中的结束位置，offs 为每条日志的偏移
+type journalWriter interface {
+	journalAppend(b []byte) int64
+	journalDone(off int64)
+	writeJournaled(v Lvl, b []byte, ends []int, offs []int64) (int, error)
+}
+
+var _ journalWriter = &FileBackend{}
+
+// journalAppend 记录到崩溃恢复缓冲，没有开启时返回 noJournal
+// p.journal 只在 NewFileBackend 中设置，关闭后也不置为nil，由 journal.closed 保护，所以这里不需要 p.mu
+func (p *FileBackend) journalAppend(b []byte) int64 {
+	if p.journal == nil {
+		return noJournal
+	}
+	return p.journal.append(b)
+}
+
+// journalDone 标记记录已经处理完，不需要恢复
+func (p *FileBackend) journalDone(off int64) {
+	if p.journal != nil {
+		p.journal.done(off)
+	}
+}
+
+// writeJournaled 写入已经记录到崩溃恢复缓冲的一条或多条日志，写入日志文件后才会标记完成
+// 多条日志按 ends 逐条放入 buffer，保证切分和索引落在日志边界上，ends 为nil时b为一条日志
+func (p *FileBackend) writeJournaled(v Lvl, b []byte, ends []int, offs []int64) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, errBackendClosed
+	}
+	if len(ends) == 0 {
+		ends = []int{len(b)}
+	}
+	start := 0
+	for i, end := range ends {
+		off := noJournal
+		if i < len(offs) {
+			off = offs[i]
+		}
+		m, werr := p.write(b[start:end], off)
+		n += m
+		if werr != nil && m == 0 && err == nil {
+			err = werr // 按 Fallback 处理了
+		}
+		start = end
+	}
+	if err != nil {
+		return
+	}
+	switch {
+	case p.durability == DurabilityFlushEach:
+		err = p.flush() // 已经在 buffer 中了，失败时等待重试，同时返回错误
+	case p.durability == DurabilitySyncError && v >= ERROR:
+		err = p.sync()
+	}
+	if err == nil {
+		err = p.err // 失败状态下日志留在 buffer 中等待重试
+	}
+	return
+}
+
+// journalFlushed buffer 已经全部写入日志文件，标记其中的记录完成，调用时需要持有 p.mu
+func (p *FileBackend) journalFlushed() {
+	for _, off := range p.journalPending {
+		p.journalDone(off)
+	}
+	p.journalPending = p.journalPending[:0]
+}
+
+// recoverJournal 打开崩溃恢复缓冲，把上次没有写入日志文件的记录加上标记后写入
+func (p *FileBackend) recoverJournal(filePath string, capacity int) {
+	j, pending, err := openJournal(filePath, capacity, p.fileMode)
+	if err != nil {
+		internalLog("FileBackend: open journal %s failed: %v", filePath, err)
+		return
+	}
+	p.journal = j
+	if len(pending) <= 0 {
+		return
+	}
+	for _, b := range pending {
+		b = markRecovered(b)
+		p.writeJournaled(0, b, nil, []int64{p.journalAppend(b)})
+	}
+	p.Sync()
+	internalLog("FileBackend: recovered %d entries from journal %s", len(pending), filePath)
+}
+
+// errMmapNotSupported 当前平台不支持 mmap
+var errMmapNotSupported = errors.New("dlog: mmap journal is not supported on this platform")
@@ -0,0 +1,33 @@
+package dlog
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestJournalWriteDuringClose 关闭时还在写的日志不能访问已经解除mmap的缓冲
+func TestJournalWriteDuringClose(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 20; i++ {
+		fb, err := NewFileBackendWithConfig(dir, "journal.log", FileBackendConfig{JournalPath: filepath.Join(dir, fmt.Sprintf("journal%d.ring", i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dw := NewDLogWriterWithConfig(fb, DLogWriterConfig{Console: ConsoleOff})
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := 0; n < 200; n++ {
+					dw.WriteLevel(INFO, []byte("{\"msg\":\"x\"}\n"))
+					fb.journalAppend([]byte("direct\n"))
+				}
+			}()
+		}
+		dw.Close()
+		wg.Wait()
+	}
+}
@@ -0,0 +1,97 @@
+package dlog
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// badKey kv 不合法时使用的key，比如kv个数为奇数或者key不是string
+const badKey = "!BADKEY"
+
+// KVCheckMode kv 不合法时的处理方式
+type KVCheckMode uint8
+
+const (
+	KVCheckProduction  KVCheckMode = iota // 默认，不合法的部分输出为 !BADKEY 字段
+	KVCheckDevelopment                    // 同时额外输出一条WARN日志，指出调用位置
+	KVCheckPanic                          // 直接panic，适合单元测试
+)
+
+var _kvCheckMode = KVCheckProduction
+
+// SetKVCheckMode 设置 kv 不合法时的处理方式，开发环境建议使用 KVCheckDevelopment
+func SetKVCheckMode(mode KVCheckMode) {
+	_kvCheckMode = mode
+}
+
+// kvPair 一对kv
+type kvPair struct {
+	key string
+	val interface{}
+}
+
+// parseKV 解析成对的kv，类似: name,张三,age,10,...
+// key 不是string时该元素单独作为 !BADKEY 的值，最后一个key没有value时key作为 !BADKEY 的值
+// problems 为不合法之处的描述
+func parseKV(kv []interface{}) (pairs []kvPair, problems []string) {
+	for i := 0; i < len(kv); {
+		key, ok := kv[i].(string)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("key at index %d is %T, not string", i, kv[i]))
+			pairs = append(pairs, kvPair{badKey, kv[i]})
+			i++
+			continue
+		}
+		if i+1 >= len(kv) {
+			problems = append(problems, fmt.Sprintf("key %q at index %d has no value", key, i))
+			pairs = append(pairs, kvPair{badKey, key})
+			i++
+			continue
+		}
+		pairs = append(pairs, kvPair{key, kv[i+1]})
+		i += 2
+	}
+	return
+}
+
+// badKVMessage 根据 SetKVCheckMode 处理不合法的kv
+// KVCheckPanic 时直接panic，KVCheckDevelopment 时返回需要额外输出的告警信息，其它情况返回空字符串
+func badKVMessage(problems []string, file string, line int) string {
+	if len(problems) <= 0 || _kvCheckMode == KVCheckProduction {
+		return ""
+	}
+	msg := fmt.Sprintf("dlog: malformed kv at %s:%d: %s", file, line, strings.Join(problems, "; "))
+	if _kvCheckMode == KVCheckPanic {
+		panic(msg)
+	}
+	return msg
+}
+
+// badKVEntry 生成 KVCheckDevelopment 下额外输出的告警日志，没有需要输出的时返回nil
+func badKVEntry(ctx context.Context, prefix string, problems []string, file string, line int) *logEntry {
+	msg := badKVMessage(problems, file, line)
+	if len(msg) <= 0 {
+		return nil
+	}
+	e := newStdLogEntry(ctx, prefix, logLevels[WARN], file, line)
+	e.set("dlog_warning", msg)
+	return e
+}
+
+// externalCaller 获取dlog包外的调用位置，用于调用层数不固定的地方
+func externalCaller() (file string, line int) {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "github.com/dajinkuang/dlog.") {
+			return getFilePath(frame.File), frame.Line
+		}
+		if !more {
+			return getFilePath(frame.File), frame.Line
+		}
+	}
+}
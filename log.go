@@ -2,15 +2,9 @@ package dlog
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"path"
 	"runtime"
-	"time"
 
-	"github.com/dajinkuang/util/glsutil"
-	"github.com/dajinkuang/util/iputil"
-	"github.com/dajinkuang/util/ordermaputil"
 	"github.com/dajinkuang/villa-go/log"
 )
 
@@ -98,7 +92,9 @@ func Error(kv ...interface{}) {
 		return
 	}
 	GetLogger().Error(kv...)
-	GetLoggerError().Error(kv...)
+	if !errorRouted() {
+		GetLoggerError().Error(kv...)
+	}
 }
 
 // Fatal 包调用，打印fatal日志
@@ -108,7 +104,9 @@ func Fatal(kv ...interface{}) {
 		return
 	}
 	GetLogger().Fatal(kv...)
-	GetLoggerError().Fatal(kv...)
+	if !errorRouted() {
+		GetLoggerError().Fatal(kv...)
+	}
 }
 
 // DebugContext 包调用，打印debug日志，context
@@ -145,7 +143,9 @@ func ErrorContext(ctx context.Context, kv ...interface{}) {
 		return
 	}
 	GetLogger().ErrorContext(ctx, kv...)
-	GetLoggerError().ErrorContext(ctx, kv...)
+	if !errorRouted() {
+		GetLoggerError().ErrorContext(ctx, kv...)
+	}
 }
 
 // FatalContext 包调用，打印fatal日志，context
@@ -155,7 +155,9 @@ func FatalContext(ctx context.Context, kv ...interface{}) {
 		return
 	}
 	GetLogger().FatalContext(ctx, kv...)
-	GetLoggerError().FatalContext(ctx, kv...)
+	if !errorRouted() {
+		GetLoggerError().FatalContext(ctx, kv...)
+	}
 }
 
 // With 向ctx设置kv
@@ -185,6 +187,44 @@ func Close() error {
 	return GetLogger().Close()
 }
 
+// FlushContext 等到已经打印的日志都写入文件，ctx 结束时返回错误，Logger 不支持时什么也不做
+func FlushContext(ctx context.Context) error {
+	if logV2Open {
+		log.Sync()
+		return nil
+	}
+	var err error
+	for _, l := range []Logger{GetLogger(), GetLoggerError()} {
+		if f, ok := l.(interface{ Flush(context.Context) error }); ok {
+			if flushErr := f.Flush(ctx); err == nil {
+				err = flushErr
+			}
+		}
+	}
+	return err
+}
+
+// CloseContext 清空并关闭日志，ctx 结束时放弃剩下的日志并返回错误
+func CloseContext(ctx context.Context) error {
+	if logV2Open {
+		log.Sync()
+		return nil
+	}
+	var err error
+	for _, l := range []Logger{GetLoggerError(), GetLogger()} {
+		var closeErr error
+		if c, ok := l.(interface{ CloseContext(context.Context) error }); ok {
+			closeErr = c.CloseContext(ctx)
+		} else {
+			closeErr = l.Close()
+		}
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
 // EnableDebug debug开关
 func EnableDebug(b bool) {
 	if logV2Open {
@@ -195,40 +235,14 @@ func EnableDebug(b bool) {
 
 // logJSON 生成日志数据JSON字符串。kv 应该是成对的数据, 类似: name,张三,age,10,...
 func logJSON(v Lvl, kv ...interface{}) string {
-	om := ordermaputil.NewOrderMap()
 	_, file, line, _ := runtime.Caller(2)
 	file = getFilePath(file)
-	om.Set("dlog_prefix", prefix)
-	om.Set("level", logLevels[v])
-	now := time.Now()
-	om.Set("cur_time", now.Format(time.RFC3339Nano))
-	om.Set("cur_unix_time", now.Unix())
-	om.Set("file", file)
-	om.Set("line", line)
-	localMachineIPV4, _ := iputil.LocalMachineIPV4()
-	om.Set("local_machine_ipv4", localMachineIPV4)
-	ctx, ctxIsDefault := glsutil.GlsContext()
-	if !ctxIsDefault {
-		om.Set(TraceID, ValueFromOM(ctx, TraceID))
-		om.Set(SpanID, ValueFromOM(ctx, SpanID))
-		om.Set(ParentID, ValueFromOM(ctx, ParentID))
-		om.Set(UserRequestIP, ValueFromOM(ctx, UserRequestIP))
-		om.AddValues(FromContext(ctx))
-	} else {
-		traceID, pSpanID, spanID := glsutil.GetOpenTracingFromGls()
-		om.Set(TraceID, traceID)
-		om.Set(SpanID, spanID)
-		om.Set(ParentID, pSpanID)
-	}
-	if len(kv)%2 != 0 {
-		kv = append(kv, "unknown")
-	}
-	for i := 0; i < len(kv); i += 2 {
-		om.Set(fmt.Sprintf("%v", kv[i]), kv[i+1])
+	e := newStdLogEntry(nil, prefix, logLevels[v], file, line)
+	problems := e.addKV(kv...)
+	if w := badKVEntry(nil, prefix, problems, file, line); w != nil {
+		log.Warn(string(w.encode()))
 	}
-	str, _ := json.Marshal(om)
-	//str = append(str, []byte("\n")...)
-	return string(str)
+	return string(e.encode())
 }
 
 var logLevels = []string{
@@ -0,0 +1,129 @@
+package dlog
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// ObjectMarshaler 自定义对象在日志中的输出方式
+// 实现该接口的值不再整体 json.Marshal，只输出 MarshalLogObject 中添加的字段，可用来隐藏敏感字段或展开类型
+type ObjectMarshaler interface {
+	MarshalLogObject(enc ObjectEncoder) error
+}
+
+// ArrayMarshaler 自定义数组在日志中的输出方式
+type ArrayMarshaler interface {
+	MarshalLogArray(enc ArrayEncoder) error
+}
+
+// ObjectEncoder 供 ObjectMarshaler 添加字段，val 也可以是 ObjectMarshaler/ArrayMarshaler
+type ObjectEncoder interface {
+	Add(key string, val interface{})
+}
+
+// ArrayEncoder 供 ArrayMarshaler 添加元素，val 也可以是 ObjectMarshaler/ArrayMarshaler
+type ArrayEncoder interface {
+	Append(val interface{})
+}
+
+// logObject ObjectEncoder 实现，按添加顺序保存字段
+type logObject struct {
+	keys []string
+	vals []interface{}
+}
+
+// Add 添加字段
+func (o *logObject) Add(key string, val interface{}) {
+	o.keys = append(o.keys, key)
+	o.vals = append(o.vals, val)
+}
+
+// MarshalJSON 按添加顺序输出json对象
+func (o *logObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(logValue(o.vals[i]))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// logArray ArrayEncoder 实现
+type logArray []interface{}
+
+// Append 添加元素
+func (a *logArray) Append(val interface{}) {
+	*a = append(*a, val)
+}
+
+// MarshalJSON 输出json数组
+func (a logArray) MarshalJSON() ([]byte, error) {
+	vals := make([]interface{}, len(a))
+	for i, val := range a {
+		vals[i] = logValue(val)
+	}
+	return json.Marshal(vals)
+}
+
+// objectMarshalerJSON 把 ObjectMarshaler 适配成 json.Marshaler
+type objectMarshalerJSON struct {
+	ObjectMarshaler
+}
+
+// MarshalJSON 调用 MarshalLogObject 生成json
+func (m objectMarshalerJSON) MarshalJSON() ([]byte, error) {
+	obj := new(logObject)
+	if err := m.MarshalLogObject(obj); err != nil {
+		return nil, err
+	}
+	return obj.MarshalJSON()
+}
+
+// arrayMarshalerJSON 把 ArrayMarshaler 适配成 json.Marshaler
+type arrayMarshalerJSON struct {
+	ArrayMarshaler
+}
+
+// MarshalJSON 调用 MarshalLogArray 生成json
+func (m arrayMarshalerJSON) MarshalJSON() ([]byte, error) {
+	arr := new(logArray)
+	if err := m.MarshalLogArray(arr); err != nil {
+		return nil, err
+	}
+	return arr.MarshalJSON()
+}
+
+// logValue 实现了 ObjectMarshaler/ArrayMarshaler 的值包装成 json.Marshaler，其它值原样返回
+func logValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case ObjectMarshaler:
+		return objectMarshalerJSON{v}
+	case ArrayMarshaler:
+		return arrayMarshalerJSON{v}
+	}
+	return val
+}
+
+// textValue 文本日志中的值，实现了 ObjectMarshaler/ArrayMarshaler 的值输出为json
+func textValue(val interface{}) interface{} {
+	switch val.(type) {
+	case ObjectMarshaler, ArrayMarshaler:
+		b, err := json.Marshal(logValue(val))
+		if err != nil {
+			return err.Error() // 不能回退成 %+v，否则会输出本想隐藏的字段
+		}
+		return string(b)
+	}
+	return val
+}
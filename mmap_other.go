@@ -0,0 +1,17 @@
+//go:build !unix
+
+package dlog
+
+import (
+	"os"
+)
+
+// mmapFile 当前平台不支持 mmap
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errMmapNotSupported
+}
+
+// munmapFile 当前平台不支持 mmap
+func munmapFile(b []byte) error {
+	return errMmapNotSupported
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package dlog
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile 以共享可写的方式mmap整个文件
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// munmapFile 解除mmap
+func munmapFile(b []byte) error {
+	return syscall.Munmap(b)
+}
@@ -0,0 +1,101 @@
+package dlog
+
+// fileEvent 文件切分、关闭或失败事件，err 不为nil表示失败，newPath 为空表示关闭
+type fileEvent struct {
+	closedPath string
+	newPath    string
+	err        error
+}
+
+// postEvent 把事件放入队列交给 notifier 执行，不会阻塞写操作
+func (p *FileBackend) postEvent(ev fileEvent) {
+	p.eventMu.Lock()
+	p.events = append(p.events, ev)
+	if len(ev.newPath) > 0 {
+		p.rotating[ev.closedPath] = true
+	}
+	p.eventMu.Unlock()
+	select {
+	case p.eventCh <- struct{}{}:
+	default:
+	}
+}
+
+// notifier 依次执行 OnRotate OnClose OnError 回调，Close 之后执行完队列中的事件才退出
+func (p *FileBackend) notifier() {
+	defer close(p.eventDone)
+	for {
+		p.eventMu.Lock()
+		events, closed := p.events, p.eventsClosed
+		p.events = nil
+		p.eventMu.Unlock()
+		for _, ev := range events {
+			p.handleEvent(ev)
+		}
+		if len(events) > 0 {
+			continue
+		}
+		if closed {
+			return
+		}
+		<-p.eventCh
+	}
+}
+
+// handleEvent 执行回调，回调 panic 时记录下来，不影响后面的事件
+func (p *FileBackend) handleEvent(ev fileEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			internalLog("FileBackend: callback for %s panic: %v", ev.closedPath, r)
+		}
+	}()
+	if ev.err != nil {
+		p.onError(ev.err)
+		return
+	}
+	if len(ev.newPath) <= 0 {
+		if p.onClose != nil {
+			p.onClose(ev.closedPath)
+		}
+		return
+	}
+	defer func() {
+		// 回调执行完才压缩和清理，回调中拿到的总是还存在的未压缩的文件
+		p.eventMu.Lock()
+		delete(p.rotating, ev.closedPath)
+		p.eventMu.Unlock()
+		p.notifyCompress()
+		p.notifyJanitor()
+	}()
+	if p.onRotate != nil {
+		p.onRotate(ev.closedPath, ev.newPath)
+	}
+}
+
+// inRotateCallback 文件的 OnRotate 回调还没有执行完
+func (p *FileBackend) inRotateCallback(filePath string) bool {
+	if p.eventDone == nil {
+		return false
+	}
+	p.eventMu.Lock()
+	defer p.eventMu.Unlock()
+	return p.rotating[filePath]
+}
+
+// closeEvents 放入关闭事件并等待所有回调执行完
+func (p *FileBackend) closeEvents(closedPath string) {
+	if p.eventDone == nil {
+		return
+	}
+	p.eventMu.Lock()
+	if len(closedPath) > 0 {
+		p.events = append(p.events, fileEvent{closedPath: closedPath})
+	}
+	p.eventsClosed = true
+	p.eventMu.Unlock()
+	select {
+	case p.eventCh <- struct{}{}:
+	default:
+	}
+	<-p.eventDone
+}
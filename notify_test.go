@@ -0,0 +1,42 @@
+package dlog
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestOnRotateBeforeRetention OnRotate 回调拿到的文件在回调执行完之前不会被 Retention 删除
+func TestOnRotateBeforeRetention(t *testing.T) {
+	var mu sync.Mutex
+	var missing []string
+	fb, err := NewFileBackendWithConfig(t.TempDir(), "notify.log", FileBackendConfig{
+		MaxSize:       1024,
+		FlushInterval: time.Millisecond,
+		Retention:     RetentionConfig{MaxFiles: 1, OnRemove: func(string, string) {}},
+		OnRotate: func(closedPath, newPath string) {
+			time.Sleep(5 * time.Millisecond) // 模拟归档，给 janitor 删除的机会
+			if _, err := os.Stat(closedPath); err != nil {
+				mu.Lock()
+				missing = append(missing, closedPath)
+				mu.Unlock()
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(strings.Repeat("x", 255) + "\n")
+	for i := 0; i < 40; i++ {
+		fb.Write(line)
+		time.Sleep(time.Millisecond)
+	}
+	if err := fb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) > 0 {
+		t.Errorf("files removed before OnRotate: %v", missing)
+	}
+}
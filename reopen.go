@@ -0,0 +1,117 @@
+package dlog
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Reopen 重新打开当前路径的文件，用于外部 logrotate 移走或清空文件之后
+// buffer 中还没写入的数据会写到新打开的文件中
+func (p *FileBackend) Reopen() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reopen()
+}
+
+// reopen 调用时需要持有 p.mu
+func (p *FileBackend) reopen() error {
+	if p.closed {
+		return errBackendClosed
+	}
+	if p.file == nil {
+		return p.err // 还没有打开成功，由 rotate 重试
+	}
+	newFile, err := p.openLogFile(p.filePath, fileFlag)
+	if err != nil {
+		return err
+	}
+	// 路径还指向原来的文件并且没有被清空时，比如只是收到 SIGHUP，接着使用原来的索引
+	same := false
+	info, err := newFile.Stat()
+	if opened, openedErr := p.file.Stat(); err == nil && openedErr == nil {
+		same = os.SameFile(info, opened) && info.Size() >= p.size-int64(len(p.buf))
+	}
+	p.file.Close()
+	p.file = newFile
+	p.size = int64(len(p.buf))
+	if err == nil {
+		p.size += info.Size()
+	}
+	if same {
+		return nil
+	}
+	p.openIndex(true) // 原来的索引属于被移走或清空的文件
+	p.writeHeader()
+	return nil
+}
+
+// needReopen 当前路径的文件是否已经不是打开的文件，或者被清空了，调用时需要持有 p.mu
+func (p *FileBackend) needReopen() bool {
+	if p.file == nil || p.closed {
+		return false
+	}
+	info, err := os.Stat(p.filePath)
+	if err != nil {
+		return true // 被移走或者删除了
+	}
+	opened, err := p.file.Stat()
+	if err != nil || !os.SameFile(info, opened) {
+		return true
+	}
+	return info.Size() < p.size-int64(len(p.buf)) // 被清空了，比如 logrotate 的 copytruncate
+}
+
+// watchReopen 定期检查文件是否被外部移走或清空，以及收到 SIGHUP 时重新打开文件，直到 FileBackend 关闭
+func (p *FileBackend) watchReopen(checkDuration time.Duration, onSIGHUP bool) {
+	var tick <-chan time.Time
+	if checkDuration > 0 {
+		ticker := time.NewTicker(checkDuration)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var hup chan os.Signal
+	if onSIGHUP {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+	for {
+		select {
+		case <-tick:
+			p.reopenIfNeeded(false)
+		case <-hup:
+			p.reopenIfNeeded(true)
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+// reopenIfDeleted 当前文件或者所在目录被删除时重新创建，FlushInterval 检查一次
+func (p *FileBackend) reopenIfDeleted() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.file == nil || p.closed {
+		return
+	}
+	if _, err := os.Stat(p.filePath); !os.IsNotExist(err) {
+		return
+	}
+	if err := p.reopen(); err != nil {
+		internalLog("FileBackend: recreate %s failed: %v", p.filePath, err)
+	}
+}
+
+// reopenIfNeeded 文件被外部移走或清空时重新打开，force 为true时总是重新打开
+func (p *FileBackend) reopenIfNeeded(force bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !force && !p.needReopen() {
+		return
+	}
+	if err := p.reopen(); err != nil {
+		internalLog("FileBackend: reopen %s failed: %v", p.filePath, err)
+	}
+}
@@ -0,0 +1,241 @@
+package dlog
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retentionCheckDuration 清理历史文件的检查间隔，切分文件时也会立即检查一次
+const retentionCheckDuration = time.Minute
+
+// RetentionConfig 历史日志文件的保留策略，按 FileBackend 的文件名模板匹配同一系列的文件，当前正在写的文件不会被删除
+// 限制按目录计算：同一目录下所有开启了 Retention 的 FileBackend (比如 DefaultRoutes 的 std 和 error 文件)的文件一起统计，
+// 从最旧的开始删除，使用触发清理的 FileBackend 的配置，所以同一目录下应该使用相同的 RetentionConfig
+type RetentionConfig struct {
+	MaxAge       time.Duration // 最后修改时间超过 MaxAge 的文件会被删除，<=0 不限制
+	MaxFiles     int           // 目录中最多保留的文件个数，包括当前文件，<=0 不限制
+	MaxTotalSize int64         // 目录中所有文件的总字节数上限，超过时从最旧的开始删除，<=0 不限制
+	// OnRemove 每删除一个文件回调一次，reason 为 max_age max_files max_total_size 之一
+	// 为nil时输出一行诊断信息到stderr
+	OnRemove func(filePath string, reason string)
+}
+
+func (c RetentionConfig) enabled() bool {
+	return c.MaxAge > 0 || c.MaxFiles > 0 || c.MaxTotalSize > 0
+}
+
+// logFile 一个历史日志文件
+type logFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// retentionDir 同一目录下开启了 Retention 的 FileBackend
+type retentionDir struct {
+	mu       sync.Mutex // 同一目录同时只有一个 janitor 在清理
+	backends []*FileBackend
+}
+
+var (
+	_retentionDirsMu sync.Mutex
+	_retentionDirs   = make(map[string]*retentionDir)
+)
+
+// registerRetention 加入所在目录，该目录的 janitor 一起统计它的文件
+func (p *FileBackend) registerRetention() {
+	_retentionDirsMu.Lock()
+	defer _retentionDirsMu.Unlock()
+	key := filepath.Clean(p.dir)
+	d, ok := _retentionDirs[key]
+	if !ok {
+		d = new(retentionDir)
+		_retentionDirs[key] = d
+	}
+	d.mu.Lock()
+	d.backends = append(d.backends, p)
+	d.mu.Unlock()
+	p.retentionDir = d
+}
+
+// unregisterRetention Close 时离开所在目录，调用时不能持有 p.mu
+func (p *FileBackend) unregisterRetention() {
+	_retentionDirsMu.Lock()
+	defer _retentionDirsMu.Unlock()
+	d := p.retentionDir
+	d.mu.Lock()
+	for i, b := range d.backends {
+		if b == p {
+			d.backends = append(d.backends[:i], d.backends[i+1:]...)
+			break
+		}
+	}
+	empty := len(d.backends) <= 0
+	d.mu.Unlock()
+	if key := filepath.Clean(p.dir); empty && _retentionDirs[key] == d {
+		delete(_retentionDirs, key)
+	}
+}
+
+// janitor 后台定期清理历史文件，直到 FileBackend 关闭
+func (p *FileBackend) janitor() {
+	ticker := time.NewTicker(retentionCheckDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.rotateCh:
+		case <-p.closeCh:
+			return
+		}
+		p.removeExpiredFiles()
+	}
+}
+
+// notifyRotate 通知 janitor 和 compressor 文件已经切分，不会阻塞写操作
+// 设置了 OnRotate OnClose 时由 notifier 在回调执行完后再通知一次
+func (p *FileBackend) notifyRotate() {
+	p.notifyJanitor()
+	if p.eventDone == nil {
+		p.notifyCompress()
+	}
+}
+
+// notifyJanitor 通知 janitor 清理历史文件，不会阻塞
+func (p *FileBackend) notifyJanitor() {
+	select {
+	case p.rotateCh <- struct{}{}:
+	default:
+	}
+}
+
+// notifyCompress 通知 compressor 压缩历史文件，不会阻塞
+func (p *FileBackend) notifyCompress() {
+	select {
+	case p.compressCh <- struct{}{}:
+	default:
+	}
+}
+
+// ownedFile 目录中的一个文件和它所属的 FileBackend
+type ownedFile struct {
+	logFile
+	owner *FileBackend
+}
+
+// removeExpiredFiles 按 RetentionConfig 删除目录中最旧的文件，包括同一目录下其它 FileBackend 的文件
+func (p *FileBackend) removeExpiredFiles() {
+	d := p.retentionDir
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var files []ownedFile
+	seen := make(map[string]bool)
+	for _, owner := range d.backends {
+		for _, f := range owner.listFiles() {
+			if !seen[f.path] {
+				seen[f.path] = true
+				files = append(files, ownedFile{logFile: f, owner: owner})
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	count := len(files)
+	deadline := p.now().Add(-p.retention.MaxAge)
+	for _, f := range files {
+		if f.owner.inRotateCallback(f.path) {
+			continue // OnRotate 回调执行完才能删除
+		}
+		reason := ""
+		switch {
+		case p.retention.MaxAge > 0 && f.modTime.Before(deadline):
+			reason = "max_age"
+		case p.retention.MaxFiles > 0 && count > p.retention.MaxFiles:
+			reason = "max_files"
+		case p.retention.MaxTotalSize > 0 && total > p.retention.MaxTotalSize:
+			reason = "max_total_size"
+		default:
+			continue
+		}
+		if f.owner.isCurrentFile(f.path) {
+			continue // 正在写的文件，包括遍历目录期间切分出的新文件
+		}
+		if err := os.Remove(f.path); err != nil {
+			internalLog("FileBackend: remove %s failed: %v", f.path, err)
+			continue
+		}
+		os.Remove(indexPath(f.path))
+		f.owner.removeEmptyDirs(path.Dir(f.path))
+		count--
+		total -= f.size
+		if p.retention.OnRemove != nil {
+			p.retention.OnRemove(f.path, reason)
+		} else {
+			internalLog("FileBackend: removed %s reason=%s", f.path, reason)
+		}
+	}
+}
+
+// listFiles 列出目录中属于该 FileBackend 的所有文件，设置了 DirLayout 时包括子目录
+func (p *FileBackend) listFiles() []logFile {
+	files, _ := listLogFiles(p.dir, p.pattern, len(p.layout) > 0)
+	return files
+}
+
+// listLogFiles 列出目录中文件名匹配 pattern 的所有文件，recursive 为true时包括子目录
+func listLogFiles(dir string, pattern *regexp.Regexp, recursive bool) ([]logFile, error) {
+	var files []logFile
+	err := filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if filePath == dir {
+				return err
+			}
+			return nil // 子目录可能正在被删除
+		}
+		if entry.IsDir() {
+			if filePath != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !pattern.MatchString(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, logFile{
+			path:    filePath,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// removeEmptyDirs 删除 DirLayout 生成的已经空了的目录，直到 FileBackend 的目录为止
+func (p *FileBackend) removeEmptyDirs(dir string) {
+	if len(p.layout) <= 0 {
+		return
+	}
+	for dir != p.dir && strings.HasPrefix(dir, p.dir+"/") {
+		if os.Remove(dir) != nil {
+			return // 不为空或者已经被删除
+		}
+		dir = path.Dir(dir)
+	}
+}
@@ -0,0 +1,48 @@
+package dlog
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestRetentionPerDirectory 同一目录下多个 FileBackend 的文件一起按 MaxFiles 统计
+func TestRetentionPerDirectory(t *testing.T) {
+	dir := t.TempDir()
+	cfg := FileBackendConfig{
+		MaxSize:   256,
+		Retention: RetentionConfig{MaxFiles: 3, OnRemove: func(string, string) {}},
+	}
+	var backends []*FileBackend
+	for _, name := range []string{"topic.log_json_std", "topic.log_json_error"} {
+		fb, err := NewFileBackendWithConfig(dir, name, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, fb)
+	}
+	line := []byte(strings.Repeat("x", 99) + "\n")
+	for i := 0; i < 20; i++ {
+		for _, fb := range backends {
+			fb.Write(line)
+			fb.Flush()
+		}
+	}
+	backends[0].removeExpiredFiles()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("%d files left in the directory, want 3: %v", len(entries), names)
+	}
+	for _, fb := range backends {
+		if err := fb.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
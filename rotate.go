@@ -0,0 +1,212 @@
+package dlog
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 常用的文件切分周期，也可以使用其它任意时长，比如 10 * time.Minute
+const (
+	RotateMinutely = time.Minute
+	RotateHourly   = time.Hour
+	RotateDaily    = 24 * time.Hour
+)
+
+// Segment 一个日志文件，文件名由 Period 和 Seq 按文件名模板生成
+type Segment struct {
+	Period time.Time // 所在切分周期的开始时间
+	Seq    int       // 同一周期内的编号，从0开始
+}
+
+// Equal 是否是同一个文件
+func (s Segment) Equal(o Segment) bool {
+	return s.Period.Equal(o.Period) && s.Seq == o.Seq
+}
+
+// RotationState 当前文件的状态
+type RotationState struct {
+	Segment Segment // 当前文件，FileBackend 刚创建时为零值
+	Size    int64   // 当前文件已经写入的字节数，包括还在buffer中的
+}
+
+// RotationPolicy 文件切分策略，决定什么时候切分以及切分后写哪个文件
+// 每次写入前调用 Next，返回的 Segment 和当前的不同时切换文件
+// now 由 FileBackend 的 Clock 提供，Next 不应该自己取时间，这样用固定时间就能测试
+type RotationPolicy interface {
+	Next(now time.Time, cur RotationState, n int) Segment
+}
+
+// TimeRotation 按时间周期切分，进入新的周期时编号从0开始
+type TimeRotation struct {
+	Interval time.Duration // 切分周期，<=0 时为 RotateHourly
+}
+
+// Next 实现 RotationPolicy
+func (r TimeRotation) Next(now time.Time, cur RotationState, n int) Segment {
+	period := periodStart(now, r.Interval)
+	if !period.Equal(cur.Segment.Period) {
+		return Segment{Period: period}
+	}
+	return cur.Segment
+}
+
+// SizeRotation 按大小切分，写入后超过 MaxSize 时切换到下一个编号，单条超过 MaxSize 的数据写入空文件
+// 单独使用时 Period 为第一次打开文件的时间(精确到秒)
+type SizeRotation struct {
+	MaxSize int64 // 单个文件的最大字节数，<=0 不限制
+}
+
+// Next 实现 RotationPolicy
+func (r SizeRotation) Next(now time.Time, cur RotationState, n int) Segment {
+	if cur.Segment.Period.IsZero() {
+		return Segment{Period: now.Truncate(time.Second)}
+	}
+	if r.MaxSize > 0 && cur.Size > 0 && cur.Size+int64(n) > r.MaxSize {
+		return Segment{Period: cur.Segment.Period, Seq: cur.Segment.Seq + 1}
+	}
+	return cur.Segment
+}
+
+// CombinedRotation 组合多个策略，按顺序第一个要求切分的策略生效，比如 CombinedRotation{TimeRotation{...}, SizeRotation{...}}
+type CombinedRotation []RotationPolicy
+
+// Next 实现 RotationPolicy
+func (r CombinedRotation) Next(now time.Time, cur RotationState, n int) Segment {
+	for _, policy := range r {
+		if seg := policy.Next(now, cur, n); !seg.Equal(cur.Segment) {
+			return seg
+		}
+	}
+	return cur.Segment
+}
+
+// rotationInterval 策略中按时间切分的周期，用于生成默认的文件名模板，没有时返回0
+func rotationInterval(policy RotationPolicy) time.Duration {
+	switch r := policy.(type) {
+	case TimeRotation:
+		if r.Interval <= 0 {
+			return RotateHourly
+		}
+		return r.Interval
+	case CombinedRotation:
+		for _, sub := range r {
+			if d := rotationInterval(sub); d > 0 {
+				return d
+			}
+		}
+	}
+	return 0
+}
+
+// periodStart t 所在切分周期的开始时间
+// 不超过一天的周期从 t 所在时区的当天零点开始对齐，超过一天的按 time.Truncate 对齐
+func periodStart(t time.Time, interval time.Duration) time.Time {
+	if interval <= 0 {
+		interval = RotateHourly
+	}
+	if interval > RotateDaily {
+		return t.Truncate(interval)
+	}
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return day.Add(t.Sub(day) / interval * interval)
+}
+
+// defaultFileNameTemplate 根据切分周期生成默认的文件名模板，小时切分时为 %N.%Y%m%d%H，没有按时间切分时精确到秒
+func defaultFileNameTemplate(interval time.Duration) string {
+	switch {
+	case interval >= RotateDaily:
+		return "%N.%Y%m%d"
+	case interval >= RotateHourly && interval%RotateHourly == 0:
+		return "%N.%Y%m%d%H"
+	case interval >= RotateMinutely && interval%RotateMinutely == 0:
+		return "%N.%Y%m%d%H%M"
+	}
+	return "%N.%Y%m%d%H%M%S"
+}
+
+// formatFileName 按模板生成文件名，支持的占位符:
+//
+//	%N FileBackend 的name，比如 topic.log_json_std
+//	%Y %m %d %H %M %S 切分周期开始时间的年月日时分秒
+//	%i 同一周期内的文件编号，从0开始
+//	%% 字符 %
+//
+// 模板中没有 %i 时，编号大于0的文件在末尾追加 .编号
+func formatFileName(template, name string, t time.Time, seq int) string {
+	var b strings.Builder
+	hasSeq := false
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '%' || i+1 >= len(template) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch template[i] {
+		case 'N':
+			b.WriteString(name)
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'i':
+			hasSeq = true
+			b.WriteString(strconv.Itoa(seq))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(template[i])
+		}
+	}
+	if !hasSeq && seq > 0 {
+		b.WriteString("." + strconv.Itoa(seq))
+	}
+	return b.String()
+}
+
+// fileNamePattern 匹配同一个模板生成的所有文件名，包括压缩后的文件，用于查找历史文件
+func fileNamePattern(template, name string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	hasSeq := false
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		if c != '%' || i+1 >= len(template) {
+			b.WriteString(regexp.QuoteMeta(string(c)))
+			continue
+		}
+		i++
+		switch template[i] {
+		case 'N':
+			b.WriteString(regexp.QuoteMeta(name))
+		case 'Y':
+			b.WriteString(`\d{4}`)
+		case 'm', 'd', 'H', 'M', 'S':
+			b.WriteString(`\d{2}`)
+		case 'i':
+			hasSeq = true
+			b.WriteString(`\d+`)
+		case '%':
+			b.WriteString("%")
+		default:
+			b.WriteString(regexp.QuoteMeta("%" + string(template[i])))
+		}
+	}
+	if !hasSeq {
+		b.WriteString(`(\.\d+)?`)
+	}
+	b.WriteString(`(\.gz|\.zst)?$`) // 压缩后的文件仍然属于同一系列
+	return regexp.MustCompile(b.String())
+}
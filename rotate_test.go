@@ -0,0 +1,208 @@
+package dlog
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPeriodStart 按本地时间对齐到切分周期的开始
+func TestPeriodStart(t *testing.T) {
+	at := time.Date(2024, 1, 15, 10, 59, 30, 0, time.Local)
+	for _, tc := range []struct {
+		interval time.Duration
+		want     time.Time
+	}{
+		{0, time.Date(2024, 1, 15, 10, 0, 0, 0, time.Local)},
+		{RotateMinutely, time.Date(2024, 1, 15, 10, 59, 0, 0, time.Local)},
+		{10 * time.Minute, time.Date(2024, 1, 15, 10, 50, 0, 0, time.Local)},
+		{RotateHourly, time.Date(2024, 1, 15, 10, 0, 0, 0, time.Local)},
+		{5 * time.Hour, time.Date(2024, 1, 15, 10, 0, 0, 0, time.Local)},
+		{RotateDaily, time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local)},
+	} {
+		if got := periodStart(at, tc.interval); !got.Equal(tc.want) {
+			t.Errorf("periodStart(%v) = %v, want %v", tc.interval, got, tc.want)
+		}
+	}
+}
+
+// TestRotationPolicyNext 按时间、按大小和组合的切分策略选择的文件
+func TestRotationPolicyNext(t *testing.T) {
+	h10 := time.Date(2024, 1, 15, 10, 0, 0, 0, time.Local)
+	h11 := h10.Add(time.Hour)
+	hourly := TimeRotation{Interval: RotateHourly}
+	size := SizeRotation{MaxSize: 100}
+	for _, tc := range []struct {
+		name   string
+		policy RotationPolicy
+		now    time.Time
+		cur    RotationState
+		n      int
+		want   Segment
+	}{
+		{"time first open", hourly, h10.Add(time.Minute), RotationState{}, 10, Segment{Period: h10}},
+		{"time same period", hourly, h10.Add(59 * time.Minute), RotationState{Segment: Segment{Period: h10, Seq: 2}, Size: 1000}, 10, Segment{Period: h10, Seq: 2}},
+		{"time next period", hourly, h11, RotationState{Segment: Segment{Period: h10, Seq: 2}}, 10, Segment{Period: h11}},
+		{"size first open", size, h10.Add(1500 * time.Millisecond), RotationState{}, 10, Segment{Period: h10.Add(time.Second)}},
+		{"size fits", size, h11, RotationState{Segment: Segment{Period: h10}, Size: 90}, 10, Segment{Period: h10}},
+		{"size full", size, h11, RotationState{Segment: Segment{Period: h10}, Size: 90}, 11, Segment{Period: h10, Seq: 1}},
+		{"size empty file", size, h11, RotationState{Segment: Segment{Period: h10, Seq: 1}}, 200, Segment{Period: h10, Seq: 1}},
+		{"combined size", CombinedRotation{hourly, size}, h10.Add(time.Minute), RotationState{Segment: Segment{Period: h10}, Size: 90}, 20, Segment{Period: h10, Seq: 1}},
+		{"combined time first", CombinedRotation{hourly, size}, h11, RotationState{Segment: Segment{Period: h10, Seq: 3}, Size: 90}, 20, Segment{Period: h11}},
+	} {
+		if got := tc.policy.Next(tc.now, tc.cur, tc.n); !got.Equal(tc.want) {
+			t.Errorf("%s: Next = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestFileNamePattern 生成的文件名能被同一模板的正则匹配，其他文件和索引文件不匹配
+func TestFileNamePattern(t *testing.T) {
+	at := time.Date(2024, 1, 5, 7, 8, 9, 0, time.Local)
+	for _, tc := range []struct {
+		template string
+		seq      int
+		want     string
+	}{
+		{"%N.%Y%m%d%H", 0, "app.log.2024010507"},
+		{"%N.%Y%m%d%H", 1, "app.log.2024010507.1"},
+		{"%N.%Y%m%d", 12, "app.log.20240105.12"},
+		{"%N.%Y%m%d%H%M%S", 0, "app.log.20240105070809"},
+		{"%N-%Y%m%d-%H.%i.log", 0, "app.log-20240105-07.0.log"},
+		{"%N-%Y%m%d-%H.%i.log", 3, "app.log-20240105-07.3.log"},
+		{"100%%.%N.%Y", 0, "100%.app.log.2024"},
+	} {
+		got := formatFileName(tc.template, "app.log", at, tc.seq)
+		if got != tc.want {
+			t.Errorf("formatFileName(%q, %d) = %q, want %q", tc.template, tc.seq, got, tc.want)
+		}
+		pattern := fileNamePattern(tc.template, "app.log")
+		if !pattern.MatchString(got) {
+			t.Errorf("pattern of %q does not match %q", tc.template, got)
+		}
+		for _, other := range []string{"other.log.2024010507", got + ".idx", "x" + got} {
+			if pattern.MatchString(other) {
+				t.Errorf("pattern of %q matches %q", tc.template, other)
+			}
+		}
+	}
+}
+
+// rotationStep 时间前进 advance 后写入 writes 条40字节的日志
+type rotationStep struct {
+	advance time.Duration
+	writes  int
+}
+
+// TestFileBackendRotation 注入的时钟跨过整点和写满 MaxSize 时生成的文件名
+func TestFileBackendRotation(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   FileBackendConfig
+		steps []rotationStep
+		want  []string
+	}{
+		{
+			name:  "hourly",
+			steps: []rotationStep{{0, 2}, {time.Minute, 1}, {time.Hour, 1}},
+			want:  []string{"r.log.2024011510", "r.log.2024011511", "r.log.2024011512"},
+		},
+		{
+			name:  "hourly and size",
+			cfg:   FileBackendConfig{MaxSize: 100},
+			steps: []rotationStep{{0, 5}, {time.Minute, 1}},
+			want:  []string{"r.log.2024011510", "r.log.2024011510.1", "r.log.2024011510.2", "r.log.2024011511"},
+		},
+		{
+			name:  "seq in template",
+			cfg:   FileBackendConfig{MaxSize: 100, FileNameTemplate: "%N-%Y%m%d-%H.%i"},
+			steps: []rotationStep{{0, 3}, {time.Minute, 1}},
+			want:  []string{"r.log-20240115-10.0", "r.log-20240115-10.1", "r.log-20240115-11.0"},
+		},
+		{
+			name:  "ten minutes",
+			cfg:   FileBackendConfig{RotateInterval: 10 * time.Minute},
+			steps: []rotationStep{{0, 1}, {time.Minute, 1}, {10 * time.Minute, 1}},
+			want:  []string{"r.log.202401151050", "r.log.202401151100", "r.log.202401151110"},
+		},
+		{
+			name:  "daily",
+			cfg:   FileBackendConfig{RotateInterval: RotateDaily},
+			steps: []rotationStep{{0, 1}, {time.Hour, 1}, {24 * time.Hour, 1}},
+			want:  []string{"r.log.20240115", "r.log.20240116"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			clock := &fakeClock{t: time.Date(2024, 1, 15, 10, 59, 0, 0, time.Local)}
+			tc.cfg.Clock = clock
+			fb, err := NewFileBackendWithConfig(dir, "r.log", tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			line := []byte(strings.Repeat("x", 39) + "\n")
+			for _, step := range tc.steps {
+				clock.Add(step.advance)
+				for i := 0; i < step.writes; i++ {
+					fb.Write(line)
+				}
+			}
+			if err := fb.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := dirNames(t, dir); strings.Join(got, " ") != strings.Join(tc.want, " ") {
+				t.Errorf("files = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestFileBackendContinuesLastSegment 重启后同一周期接着写最后一个编号的文件，写满了再切到下一个
+func TestFileBackendContinuesLastSegment(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeClock{t: time.Date(2024, 1, 15, 10, 0, 0, 0, time.Local)}
+	cfg := FileBackendConfig{Clock: clock, MaxSize: 100}
+	line := []byte(strings.Repeat("x", 39) + "\n")
+	for _, writes := range []int{3, 1, 1} {
+		fb, err := NewFileBackendWithConfig(dir, "r.log", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < writes; i++ {
+			fb.Write(line)
+		}
+		if err := fb.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]int64{"r.log.2024011510": 80, "r.log.2024011510.1": 80, "r.log.2024011510.2": 40}
+	got := dirNames(t, dir)
+	if len(got) != len(want) {
+		t.Fatalf("files = %v, want %v", got, want)
+	}
+	for name, size := range want {
+		info, err := os.Stat(dir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != size {
+			t.Errorf("%s has %d bytes, want %d", name, info.Size(), size)
+		}
+	}
+}
+
+// dirNames 目录中排序后的文件名
+func dirNames(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,139 @@
+package dlog
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Route 日志路由，满足条件的日志写入 Name 文件，一条日志可以写入多个路由
+type Route struct {
+	// Name 文件名，比如 "order.audit.log"，文件在 SetTopicRoutes 的目录下
+	Name string
+	// MinLevel 最低级别，0 表示不限制
+	MinLevel Lvl
+	// MaxLevel 最高级别，0 表示不限制
+	MaxLevel Lvl
+	// Fields 日志中这些字段的值都相同时才匹配，比如 {"audit": true}
+	Fields map[string]interface{}
+	// Match 自定义匹配，value 获取日志中字段的值，字段不存在时返回nil，比如按 cost 字段匹配慢查询
+	Match func(v Lvl, value func(key string) interface{}) bool
+	// Exclusive 为true时匹配后不再写入后面的路由，比如 DEBUG 只写入单独的文件
+	Exclusive bool
+	// Config 该文件的 FileBackend 配置，为nil时使用 SetFileBackendConfig 设置的
+	Config *FileBackendConfig
+}
+
+// DefaultRoutes 默认的路由，所有日志写入 <topic>.log_json_std，ERROR 及以上级别再写一份到 <topic>.log_json_error
+func DefaultRoutes(topic string) []Route {
+	return []Route{
+		{Name: topic + ".log_json_std"},
+		{Name: topic + ".log_json_error", MinLevel: ERROR},
+	}
+}
+
+// route 打开了文件的路由
+type route struct {
+	Route
+	dw *dLogWriter
+}
+
+// match 日志是否写入该路由
+func (r *route) match(v Lvl, e *logEntry) bool {
+	if r.MinLevel > 0 && v < r.MinLevel {
+		return false
+	}
+	if r.MaxLevel > 0 && v > r.MaxLevel {
+		return false
+	}
+	for key, want := range r.Fields {
+		val, ok := e.vals[key]
+		if !ok || !sameValue(val, want) {
+			return false
+		}
+	}
+	if r.Match != nil && !r.Match(v, e.get) {
+		return false
+	}
+	return true
+}
+
+// get 获取字段的值，ctx中的字段解码成基本类型，不存在时返回nil
+func (e *logEntry) get(key string) interface{} {
+	val, ok := e.vals[key]
+	if !ok {
+		return nil
+	}
+	if raw, ok := val.(json.RawMessage); ok {
+		var ret interface{}
+		if err := json.Unmarshal(raw, &ret); err != nil {
+			return nil
+		}
+		return ret
+	}
+	return val
+}
+
+// SetTopicRoutes 设置日志Topic，按路由把日志写入多个文件，在main中修改
+// SetTopic 相当于使用 DefaultRoutes
+func SetTopicRoutes(topic string, absolutePath string, routes ...Route) {
+	if _dLogJSON != nil {
+		_dLogJSON.Close()
+		_dLogJSONError.Close()
+	}
+	dir := "/tmp/go/log"
+	if len(absolutePath) > 0 {
+		dir = absolutePath
+	}
+	_dLogJSON = NewDLogJSONRoutes(dir, topic, routes...)
+	SetLogger(_dLogJSON)
+	// 默认Logger已经把 ERROR 日志写入了相应的路由，_dLogJSONError 只给直接使用它的地方写第一个错误路由
+	_dLogJSONError = newDLogJSON(topic)
+	_dLogJSONError.SetOutput(io.Discard)
+	for _, r := range _dLogJSON.routes {
+		if r.MinLevel >= ERROR {
+			_dLogJSONError.SetOutput(r.dw)
+			break
+		}
+	}
+	SetLoggerError(_dLogJSONError)
+}
+
+// NewDLogJSONRoutes 新建一个按路由写入多个文件的dLogJSON，Output 为第一个路由的writer
+func NewDLogJSONRoutes(dir, topic string, routes ...Route) *dLogJSON {
+	l := newDLogJSON(topic)
+	for _, r := range routes {
+		cfg := _fileBackendConfig
+		if r.Config != nil {
+			cfg = *r.Config
+		}
+		l.routes = append(l.routes, &route{Route: r, dw: NewDLogWriter(newTopicBackend(dir, r.Name, cfg))})
+	}
+	if len(l.routes) > 0 {
+		l.SetOutput(l.routes[0].dw)
+	} else {
+		l.SetOutput(io.Discard)
+	}
+	return l
+}
+
+// writeRoutes 按路由写入日志
+func (dl *dLogJSON) writeRoutes(v Lvl, e *logEntry, b []byte) (err error) {
+	for _, r := range dl.routes {
+		if !r.match(v, e) {
+			continue
+		}
+		if _, werr := r.dw.WriteLevel(v, b); werr != nil && err == nil {
+			err = werr
+		}
+		if r.Exclusive {
+			break
+		}
+	}
+	return
+}
+
+// errorRouted 默认的Logger已经按路由写入了 ERROR 及以上级别的日志，不需要再写一份到 LoggerError
+func errorRouted() bool {
+	return _dLogJSON != nil && len(_dLogJSON.routes) > 0 &&
+		_dLogger == Logger(_dLogJSON) && __dLoggerError == Logger(_dLogJSONError)
+}
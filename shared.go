@@ -0,0 +1,43 @@
+package dlog
+
+import (
+	"bytes"
+)
+
+// sharedWriteSize 共享文件模式下每次 write 的最大字节数，超过时按日志边界分成多次写入
+const sharedWriteSize = 64 * 1024
+
+// writeShared 把 buffer 按日志边界分批写入，每次 write 都是完整的若干行
+// 文件以 O_APPEND 打开，多个进程同时写时整行追加到文件末尾，不会交错或被截断
+// 返回写入的字节数，调用时需要持有 p.mu
+func (p *FileBackend) writeShared() (written int, err error) {
+	for written < len(p.buf) {
+		chunk := p.buf[written:]
+		if len(chunk) > sharedWriteSize {
+			if i := bytes.LastIndexByte(chunk[:sharedWriteSize], '\n'); i >= 0 {
+				chunk = chunk[:i+1]
+			} else if i := bytes.IndexByte(chunk, '\n'); i >= 0 {
+				chunk = chunk[:i+1] // 单条日志超过 sharedWriteSize 时整条写入
+			}
+		}
+		if p.sharedLock {
+			if err := lockFile(p.file); err != nil {
+				internalLog("FileBackend: flock %s failed: %v", p.filePath, err)
+			}
+		}
+		var n int
+		n, err = p.file.Write(chunk)
+		if p.sharedLock {
+			unlockFile(p.file)
+		}
+		written += n
+		if err != nil {
+			return
+		}
+	}
+	// 其它进程也在写，按文件的实际大小判断是否需要切分
+	if info, statErr := p.file.Stat(); statErr == nil {
+		p.size = info.Size() + int64(len(p.buf)-written)
+	}
+	return
+}
@@ -0,0 +1,117 @@
+package dlog
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 子进程写入的参数，通过环境变量传给重新执行的测试程序
+const (
+	sharedEnvDir  = "DLOG_SHARED_TEST_DIR"
+	sharedEnvID   = "DLOG_SHARED_TEST_ID"
+	sharedEnvLock = "DLOG_SHARED_TEST_LOCK"
+
+	sharedProcesses = 4
+	sharedLines     = 2000
+)
+
+// sharedPayload 每行日志的填充内容，让每次 flush 都包含很多行
+var sharedPayload = strings.Repeat("x", 200)
+
+// TestSharedWriterProcess 子进程的入口，不是由 TestSharedWriters 启动时跳过
+func TestSharedWriterProcess(t *testing.T) {
+	dir := os.Getenv(sharedEnvDir)
+	if len(dir) <= 0 {
+		t.Skip("only run as a child of TestSharedWriters")
+	}
+	id := os.Getenv(sharedEnvID)
+	fb, err := NewFileBackendWithConfig(dir, "shared.log", FileBackendConfig{
+		Shared:     true,
+		SharedLock: os.Getenv(sharedEnvLock) == "1",
+		BufferSize: 8 * 1024,
+		MaxSize:    256 * 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < sharedLines; i++ {
+		if _, err := fb.Write([]byte(fmt.Sprintf("%s %d %s\n", id, i, sharedPayload))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fb.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSharedWriters 多个进程同时写同一个文件，每一行都完整且不丢失
+func TestSharedWriters(t *testing.T) {
+	for _, lock := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lock=%v", lock), func(t *testing.T) {
+			dir := t.TempDir()
+			cmds := make([]*exec.Cmd, 0, sharedProcesses)
+			for p := 0; p < sharedProcesses; p++ {
+				cmd := exec.Command(os.Args[0], "-test.run=^TestSharedWriterProcess$", "-test.count=1")
+				cmd.Env = append(os.Environ(), sharedEnvDir+"="+dir, sharedEnvID+"="+fmt.Sprintf("p%d", p))
+				if lock {
+					cmd.Env = append(cmd.Env, sharedEnvLock+"=1")
+				}
+				cmd.Stderr = os.Stderr
+				if err := cmd.Start(); err != nil {
+					t.Fatal(err)
+				}
+				cmds = append(cmds, cmd)
+			}
+			for _, cmd := range cmds {
+				if err := cmd.Wait(); err != nil {
+					t.Fatalf("child writer failed: %v", err)
+				}
+			}
+			checkSharedLines(t, dir)
+		})
+	}
+}
+
+// checkSharedLines 所有进程写入的每一行都出现且只出现一次
+func checkSharedLines(t *testing.T, dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, "shared.log*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]int)
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			fields := strings.Split(sc.Text(), " ")
+			if len(fields) != 3 || fields[2] != sharedPayload {
+				t.Fatalf("torn line in %s: %.80q", name, sc.Text())
+			}
+			if _, err := strconv.Atoi(fields[1]); err != nil {
+				t.Fatalf("torn line in %s: %.80q", name, sc.Text())
+			}
+			seen[fields[0]+" "+fields[1]]++
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for p := 0; p < sharedProcesses; p++ {
+		for i := 0; i < sharedLines; i++ {
+			key := fmt.Sprintf("p%d %d", p, i)
+			if n := seen[key]; n != 1 {
+				t.Fatalf("line %q written %d times", key, n)
+			}
+		}
+	}
+}
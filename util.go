@@ -3,6 +3,9 @@ package dlog
 import (
 	"context"
 	"fmt"
+	"os"
+	"time"
+
 	"github.com/dajinkuang/util/ordermaputil"
 )
 
@@ -73,3 +76,8 @@ func ValueFromOM(ctx context.Context, key interface{}) interface{} {
 	}
 	return val
 }
+
+// internalLog 输出dlog自身的诊断信息到stderr，不经过日志文件
+func internalLog(format string, args ...interface{}) {
+	os.Stderr.WriteString(time.Now().String() + "," + fmt.Sprintf(format, args...) + "\n")
+}
@@ -1,100 +1,420 @@
 package dlog
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dajinkuang/errors"
 )
 
 const (
-	bufLine = 1000 // 缓存一千行
+	queueSize       = 1000 // 默认缓存一千行
+	batchBytes      = 64 * 1024
+	batchCount      = 1000
+	summaryDuration = time.Minute
 )
 
+var (
+	errWriterClosed  = errors.New("dLogWriter_closed")
+	errWriterDropped = errors.New("dLogWriter_dropped")
+)
+
+// OverflowPolicy dLogWriter 队列满了时新日志的处理方式
+type OverflowPolicy uint8
+
+const (
+	OverflowBlock      OverflowPolicy = iota // 默认，阻塞等待，设置了 BlockTimeout 时超时后丢弃
+	OverflowDropNewest                       // 丢弃新的日志
+	OverflowDropOldest                       // 丢弃队列中最旧的日志，放入新的日志
+	OverflowDropBelow                        // 丢弃低于 DropBelow 级别的日志，其它级别和不知道级别的日志同 OverflowBlock
+)
+
+// DLogWriterConfig dLogWriter 的配置，零值即默认配置
+type DLogWriterConfig struct {
+	// QueueSize 队列能缓存的日志条数，<=0 时为1000
+	QueueSize int
+	// Overflow 队列满了时的处理方式，默认 OverflowBlock
+	Overflow OverflowPolicy
+	// BlockTimeout OverflowBlock OverflowDropBelow 阻塞等待的最长时间，超时后丢弃，<=0 一直等待
+	BlockTimeout time.Duration
+	// DropBelow OverflowDropBelow 时队列满了丢弃低于这个级别的日志，比如 WARN 时丢弃 DEBUG INFO
+	// 通过 Write 写入的日志(比如文本日志 dLog)不知道级别，不会被丢弃
+	DropBelow Lvl
+	// SummaryInterval 有日志被丢弃时按这个间隔写入一条 "dlog_summary":"dropped" 的统计日志，<=0 时为1分钟
+	SummaryInterval time.Duration
+	// Console 同时输出到控制台的方式，默认输出到stdout
+	Console ConsoleMode
+	// ConsoleLevel 低于这个级别的日志不输出到控制台，0 表示都输出，通过 Write 写入、不知道级别的日志总是输出
+	ConsoleLevel Lvl
+	// ConsoleEncoder 控制台输出的格式，为nil时和写入文件的相同，比如 ColorConsoleEncoder
+	ConsoleEncoder ConsoleEncoder
+	// BatchBytes 后台写入时一次最多合并的字节数，<=0 时为64KB
+	BatchBytes int
+	// BatchCount 后台写入时一次最多合并的日志条数，<=0 时为1000
+	BatchCount int
+}
+
+var _dLogWriterConfig DLogWriterConfig
+
+// SetDLogWriterConfig 设置 NewDLogWriter 使用的默认配置，需要在 SetTopic 之前调用
+func SetDLogWriterConfig(cfg DLogWriterConfig) {
+	_dLogWriterConfig = cfg
+}
+
+// logLine 一条待写入的日志
+type logLine struct {
+	level   Lvl // 通过 Write 写入时为0，不区分级别
+	data    string
+	journal int64         // 在崩溃恢复缓冲中的偏移，见 journalWriter
+	flushed chan struct{} // 不为nil时是 Flush 放入的标记，之前的日志都写入后关闭
+}
+
 type dLogWriter struct {
-	w            io.WriteCloser
-	buffer       chan string
-	closeStartCh chan struct{}
-	closeEndCh   chan struct{}
+	dropped         uint64 // 丢弃的总条数，放在开头保证32位平台上原子操作的对齐
+	reported        uint64 // 已经写入统计日志的丢弃条数，只在 realWrite 中使用
+	enqueued        uint64 // 放入队列的总条数
+	processed       uint64 // 从队列中取出并写入底层writer(或者被丢弃)的总条数，只用来统计没有写入的条数
+	abandoned       int32  // 不为0时 Close 已经超时，后台不再写入剩下的日志
+	w               io.WriteCloser
+	buffer          chan logLine
+	overflow        OverflowPolicy
+	blockTimeout    time.Duration
+	dropBelow       Lvl
+	summaryDuration time.Duration
+	console         io.Writer // 为nil表示不输出到控制台
+	consoleLevel    Lvl
+	consoleEncoder  ConsoleEncoder
+	batchBytes      int
+	batchCount      int
+	batch           []logLine // 以下只在 realWrite 中使用，合并写入时复用
+	batchOffs       []int64
+	batchEnds       []int
+	batchBuf        []byte
+	consoleBuf      []byte
+	flushes         chan chan struct{} // 被 OverflowDropOldest 从队列中取出的 Flush 标记，交给 realWrite 关闭
+	closeOnce       sync.Once
+	closeErr        error
+	closing         chan struct{} // Close 开始后关闭，不再接收新的日志
+	quit            chan struct{} // 通知 realWrite 退出
+	exited          chan struct{} // realWrite 退出后关闭
 }
 
-// NewDLogWriter 新建一个dLogWriter
+// NewDLogWriter 新建一个dLogWriter，使用 SetDLogWriterConfig 设置的配置
 func NewDLogWriter(w io.WriteCloser) *dLogWriter {
+	return NewDLogWriterWithConfig(w, _dLogWriterConfig)
+}
+
+// NewDLogWriterWithConfig 按配置新建一个dLogWriter
+func NewDLogWriterWithConfig(w io.WriteCloser, cfg DLogWriterConfig) *dLogWriter {
 	ret := new(dLogWriter)
 	ret.w = w
-	ret.buffer = make(chan string, bufLine)
-	ret.closeStartCh = make(chan struct{})
-	ret.closeEndCh = make(chan struct{})
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = queueSize
+	}
+	ret.buffer = make(chan logLine, size)
+	ret.overflow = cfg.Overflow
+	ret.blockTimeout = cfg.BlockTimeout
+	ret.dropBelow = cfg.DropBelow
+	ret.summaryDuration = cfg.SummaryInterval
+	if ret.summaryDuration <= 0 {
+		ret.summaryDuration = summaryDuration
+	}
+	ret.console = cfg.Console.writer()
+	ret.consoleLevel = cfg.ConsoleLevel
+	ret.consoleEncoder = cfg.ConsoleEncoder
+	ret.batchBytes = cfg.BatchBytes
+	if ret.batchBytes <= 0 {
+		ret.batchBytes = batchBytes
+	}
+	ret.batchCount = cfg.BatchCount
+	if ret.batchCount <= 0 {
+		ret.batchCount = batchCount
+	}
+	ret.flushes = make(chan chan struct{})
+	ret.closing = make(chan struct{})
+	ret.quit = make(chan struct{})
+	ret.exited = make(chan struct{})
 	go ret.realWrite()
 	return ret
 }
 
 // Write 写操作
-func (w dLogWriter) Write(p []byte) (n int, err error) {
-	count := 0
-	for {
+func (w *dLogWriter) Write(p []byte) (n int, err error) {
+	return w.WriteLevel(0, p)
+}
+
+// WriteLevel 带日志级别的写操作，级别会传给同样实现了 LevelWriter 的底层writer
+// 队列满了时按 OverflowPolicy 处理，被丢弃时返回错误
+func (w *dLogWriter) WriteLevel(v Lvl, p []byte) (n int, err error) {
+	line := logLine{level: v, data: string(p), journal: noJournal}
+	select {
+	case <-w.closing:
+		return 0, errWriterClosed
+	default:
+	}
+	if jw, ok := w.w.(journalWriter); ok {
+		line.journal = jw.journalAppend(p) // 放入队列前先记录，进程崩溃时可以恢复
+	}
+	if err = w.enqueue(line); err != nil {
+		if err == errWriterClosed {
+			w.journalDone(line)
+		}
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// enqueue 放入队列，满了时按 OverflowPolicy 处理
+func (w *dLogWriter) enqueue(line logLine) (err error) {
+	select {
+	case <-w.closing:
+		return errWriterClosed
+	default:
+	}
+	defer func() {
+		if err == nil {
+			atomic.AddUint64(&w.enqueued, 1)
+		}
+	}()
+	select {
+	case w.buffer <- line:
+		return nil
+	default:
+	}
+	switch {
+	case w.overflow == OverflowDropNewest, w.overflow == OverflowDropBelow && line.level > 0 && line.level < w.dropBelow:
+		w.drop(line)
+		return errWriterDropped
+	case w.overflow == OverflowDropOldest:
+		for {
+			select {
+			case <-w.closing:
+				return errWriterClosed
+			case w.buffer <- line:
+				return nil
+			case old := <-w.buffer:
+				if old.flushed != nil {
+					// Flush 的标记不能丢弃，它之前的日志都已经取出，交给 realWrite 在写完手上的日志后关闭
+					select {
+					case w.flushes <- old.flushed:
+					case <-w.exited:
+					}
+					continue
+				}
+				w.drop(old)
+				atomic.AddUint64(&w.processed, 1)
+			}
+		}
+	}
+	var timeout <-chan time.Time
+	if w.blockTimeout > 0 {
+		timer := time.NewTimer(w.blockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-w.closing:
+		return errWriterClosed
+	case w.buffer <- line:
+		return nil
+	case <-timeout:
+		w.drop(line)
+		return errWriterDropped
+	}
+}
+
+// drop 丢弃一条日志
+func (w *dLogWriter) drop(line logLine) {
+	atomic.AddUint64(&w.dropped, 1)
+	w.journalDone(line)
+}
+
+// journalDone 不会再写入的日志从崩溃恢复缓冲中去掉
+func (w *dLogWriter) journalDone(line logLine) {
+	if jw, ok := w.w.(journalWriter); ok {
+		jw.journalDone(line.journal)
+	}
+}
+
+// Dropped 队列满了丢弃的日志总条数
+func (w *dLogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// writeSummary 有新丢弃的日志时写入一条统计日志，只在 realWrite 中调用
+func (w *dLogWriter) writeSummary() {
+	dropped := atomic.LoadUint64(&w.dropped)
+	if dropped == w.reported {
+		return
+	}
+	t := now()
+	e := newLogEntry()
+	e.set("level", "WARN")
+	e.set("cur_time", formatTime(t))
+	e.set("cur_unix_time", unixTime(t))
+	e.set("dlog_summary", "dropped")
+	e.set("dropped", dropped-w.reported)
+	e.set("dropped_total", dropped)
+	e.set("queue_size", cap(w.buffer))
+	w.reported = dropped
+	w.write([]logLine{{level: WARN, data: string(append(e.encode(), '\n')), journal: noJournal}})
+}
+
+// Flush 等到调用之前放入队列的日志都写入了底层writer，底层writer有 Flush 方法时再调用它
+// 在队列中放入一个标记，realWrite 写完标记之前的日志后关闭它
+// ctx 结束时返回错误，包括还没有写入的条数
+func (w *dLogWriter) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case w.buffer <- logLine{flushed: flushed}:
+	case <-ctx.Done():
+		return w.abandonedError(ctx.Err())
+	case <-w.exited:
+		return w.abandonedError(errWriterClosed)
+	}
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return w.abandonedError(ctx.Err())
+	case <-w.exited:
 		select {
-		case <-w.closeEndCh: // 等到end的时候才真正不让写，也就是close开始的时候还是可以写的
-			os.Stdout.WriteString(time.Now().String() + ",dLogWriter is closed\n")
-			return 0, errors.New("dLogWriter_closed")
-		case w.buffer <- string(p):
-			return len(p), nil
-		case <-time.After(time.Millisecond * 20):
-			// 如果满了，记录下来
-			count++
-			str := fmt.Sprintf(time.Now().String()+",logWrite channel is full len=%v count=%d\n", len(w.buffer), count)
-			os.Stdout.WriteString(str)
+		case <-flushed:
+		default:
+			return w.abandonedError(errWriterClosed)
 		}
 	}
-	return
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// abandonedError 加上放入队列后还没有写入的条数
+func (w *dLogWriter) abandonedError(err error) error {
+	enqueued, processed := atomic.LoadUint64(&w.enqueued), atomic.LoadUint64(&w.processed)
+	if processed >= enqueued {
+		return err
+	}
+	return fmt.Errorf("dLogWriter: %d entries abandoned: %w", enqueued-processed, err)
 }
 
-// Close 关闭
-func (w dLogWriter) Close() error {
-	os.Stdout.WriteString(time.Now().String() + ",dLogWriter: close(w.closeStartCh)\n")
-	close(w.closeStartCh)
-	<-w.closeEndCh
-	os.Stdout.WriteString(time.Now().String() + ",dLogWriter: _ <-w.closeEndCh\n")
-	err := w.w.Close()
-	os.Stdout.WriteString(time.Now().String() + ",dLogWriter: w.w.Close()\n")
-	return err
+// Close 关闭，等到之前放入队列的日志都写入后关闭底层writer
+func (w *dLogWriter) Close() error {
+	return w.CloseContext(context.Background())
 }
 
-func (w dLogWriter) realWrite() {
-	for {
+// CloseContext 关闭，不再接收新的日志，等到之前放入队列的日志都写入后关闭底层writer
+// ctx 结束时放弃剩下的日志并返回错误，包括放弃的条数，开启了崩溃恢复缓冲时这些日志下次启动时恢复
+// 放弃时仍然等后台正在写的一批写完才关闭底层writer，关闭之后不会再有写入
+func (w *dLogWriter) CloseContext(ctx context.Context) error {
+	w.closeOnce.Do(func() {
+		close(w.closing)
+		err := w.Flush(ctx)
+		if err != nil {
+			atomic.StoreInt32(&w.abandoned, 1)
+		}
+		close(w.quit)
+		<-w.exited
+		if closeErr := w.w.Close(); err == nil {
+			err = closeErr
+		}
+		w.closeErr = err
+	})
+	return w.closeErr
+}
+
+// realWrite 后台写入队列中的日志，直到 Close
+func (w *dLogWriter) realWrite() {
+	defer close(w.exited)
+	ticker := time.NewTicker(w.summaryDuration)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&w.abandoned) == 0 {
 		select {
-		case p := <-w.buffer:
-			w.write([]byte(p))
-		case <-w.closeStartCh: // 开始关闭，清空已经有的数据
-			w.Flush()           // 这个时候还可以接收新的数据了
-			close(w.closeEndCh) // 这个时候不接收新的数据了
+		case line := <-w.buffer:
+			w.writeBatch(line)
+		case flushed := <-w.flushes:
+			close(flushed)
+		case <-ticker.C:
+			w.writeSummary()
+		case <-w.quit:
+			w.drain()
 			return
 		}
 	}
-	return
 }
 
-// Flush 把当前有的数据都写进去，如果超过1s没有数据才算做清空了，但是最多等5秒
-func (w dLogWriter) Flush() (err error) {
-	ch := time.After(time.Second * 2)
-	for {
+// drain Close 开始之后可能还有刚放进来的日志，Close 没有超时的话写完
+func (w *dLogWriter) drain() {
+	for atomic.LoadInt32(&w.abandoned) == 0 {
 		select {
-		case <-time.After(time.Second * 1):
-			// 等了1s还没有数据，就认为已经清空了
-			return
-		case <-ch:
-			// 最多等2s，强制退出
+		case line := <-w.buffer:
+			w.writeBatch(line)
+		case flushed := <-w.flushes:
+			close(flushed)
+		default:
+			w.writeSummary()
 			return
-		case p := <-w.buffer:
-			w.write([]byte(p))
 		}
 	}
-	return
 }
 
-func (w dLogWriter) write(p []byte) (n int, err error) {
-	os.Stdout.Write(p)
-	return w.w.Write(p)
+// writeBatch 从 line 开始取出队列中已有的日志，不超过 BatchBytes BatchCount，合并后一次写入
+// 遇到 Flush 的标记时写完已经取出的日志后关闭它
+func (w *dLogWriter) writeBatch(line logLine) {
+	if line.flushed != nil {
+		close(line.flushed)
+		return
+	}
+	var flushed chan struct{}
+	w.batch = append(w.batch[:0], line)
+	size := len(line.data)
+loop:
+	for len(w.batch) < w.batchCount && size < w.batchBytes {
+		select {
+		case line = <-w.buffer:
+			if line.flushed != nil {
+				flushed = line.flushed
+				break loop
+			}
+			w.batch = append(w.batch, line)
+			size += len(line.data)
+		default:
+			break loop
+		}
+	}
+	if atomic.LoadInt32(&w.abandoned) != 0 {
+		return // Close 已经放弃剩下的日志，开启了崩溃恢复缓冲时下次启动恢复
+	}
+	w.write(w.batch)
+	atomic.AddUint64(&w.processed, uint64(len(w.batch)))
+	if flushed != nil {
+		close(flushed)
+	}
+}
+
+// write 把多条日志合并后一次写入控制台和底层writer，级别取其中最高的
+func (w *dLogWriter) write(lines []logLine) (n int, err error) {
+	var level Lvl
+	w.batchOffs, w.batchEnds, w.batchBuf, w.consoleBuf = w.batchOffs[:0], w.batchEnds[:0], w.batchBuf[:0], w.consoleBuf[:0]
+	for _, line := range lines {
+		if line.level > level {
+			level = line.level
+		}
+		w.batchOffs = append(w.batchOffs, line.journal)
+		w.batchBuf = append(w.batchBuf, line.data...)
+		w.batchEnds = append(w.batchEnds, len(w.batchBuf))
+		w.consoleBuf = w.appendConsole(w.consoleBuf, line)
+	}
+	if len(w.consoleBuf) > 0 {
+		w.console.Write(w.consoleBuf)
+	}
+	if jw, ok := w.w.(journalWriter); ok {
+		return jw.writeJournaled(level, w.batchBuf, w.batchEnds, w.batchOffs)
+	}
+	return writeLevel(w.w, level, w.batchBuf)
 }
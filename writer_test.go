@@ -0,0 +1,253 @@
+package dlog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memWriter 保存写入内容的writer，delay 模拟慢的磁盘
+type memWriter struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	delay time.Duration
+}
+
+func (m *memWriter) Write(p []byte) (int, error) {
+	if m.delay > 0 {
+		time.Sleep(m.delay)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.buf.Write(p)
+}
+
+func (m *memWriter) Close() error {
+	return nil
+}
+
+func (m *memWriter) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.buf.String()
+}
+
+// TestFlushConcurrent 每个goroutine Flush 返回时自己写的日志都已经写入
+func TestFlushConcurrent(t *testing.T) {
+	mw := &memWriter{delay: 50 * time.Microsecond}
+	dw := NewDLogWriterWithConfig(mw, DLogWriterConfig{Console: ConsoleOff, QueueSize: 16, BatchCount: 4})
+	defer dw.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				line := fmt.Sprintf("g%d-%d\n", g, i)
+				if _, err := dw.Write([]byte(line)); err != nil {
+					errs <- err
+					return
+				}
+				if i%10 != 9 {
+					continue
+				}
+				if err := dw.Flush(context.Background()); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Contains([]byte(mw.String()), []byte(line)) {
+					errs <- fmt.Errorf("%q not written after Flush", line)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestFlushDropOldest 队列满了时 OverflowDropOldest 取出的 Flush 标记也要关闭
+func TestFlushDropOldest(t *testing.T) {
+	mw := &memWriter{delay: 100 * time.Microsecond}
+	dw := NewDLogWriterWithConfig(mw, DLogWriterConfig{Console: ConsoleOff, QueueSize: 4, Overflow: OverflowDropOldest})
+	defer dw.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				dw.Write([]byte("line\n"))
+				if i%20 == 0 {
+					if err := dw.Flush(ctx); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestBatchRotateIndex 合并写入时 FileBackend 仍然按每条日志切分和记录索引
+func TestBatchRotateIndex(t *testing.T) {
+	dir := t.TempDir()
+	fb, err := NewFileBackendWithConfig(dir, "batch.log", FileBackendConfig{MaxSize: 4096, Index: IndexConfig{Every: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dw := NewDLogWriterWithConfig(fb, DLogWriterConfig{Console: ConsoleOff})
+	line := []byte(fmt.Sprintf("{\"msg\":%q}\n", strings.Repeat("x", 90)))
+	for i := 0; i < 1000; i++ {
+		dw.Write(line)
+	}
+	if err := dw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "batch.log*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records int
+	for _, f := range files {
+		if strings.HasSuffix(f, indexSuffix) {
+			records += len(readIndex(strings.TrimSuffix(f, indexSuffix)))
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 4096 {
+			t.Errorf("%s has %d bytes, more than MaxSize", f, info.Size())
+		}
+	}
+	if records < 100 {
+		t.Errorf("got %d index records for 1000 entries, want at least 100", records)
+	}
+}
+
+// benchmarkWriter 多个goroutine同时写入，每条日志都立即写入文件，比较逐条写入和合并写入的系统调用开销
+func benchmarkWriter(b *testing.B, batchCount int) {
+	fb, err := NewFileBackendWithConfig(b.TempDir(), "bench.log", FileBackendConfig{Durability: DurabilityFlushEach})
+	if err != nil {
+		b.Fatal(err)
+	}
+	dw := NewDLogWriterWithConfig(fb, DLogWriterConfig{Console: ConsoleOff, BatchCount: batchCount})
+	line := []byte(fmt.Sprintf("{\"level\":\"INFO\",\"msg\":%q}\n", strings.Repeat("x", 100)))
+	b.SetBytes(int64(len(line)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			dw.WriteLevel(INFO, line)
+		}
+	})
+	if err := dw.Flush(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	dw.Close()
+}
+
+// BenchmarkWriterPerLine 每次只写入一条日志
+func BenchmarkWriterPerLine(b *testing.B) {
+	benchmarkWriter(b, 1)
+}
+
+// BenchmarkWriterBatched 默认配置，合并队列中已有的日志后一次写入
+func BenchmarkWriterBatched(b *testing.B) {
+	benchmarkWriter(b, 0)
+}
+
+// TestDropBelowUnknownLevel OverflowDropBelow 不丢弃通过 Write 写入、不知道级别的日志
+func TestDropBelowUnknownLevel(t *testing.T) {
+	mw := &memWriter{delay: time.Millisecond}
+	dw := NewDLogWriterWithConfig(mw, DLogWriterConfig{Console: ConsoleOff, QueueSize: 1, Overflow: OverflowDropBelow, DropBelow: WARN})
+	for i := 0; i < 20; i++ {
+		if _, err := dw.Write([]byte(fmt.Sprintf("text %d\n", i))); err != nil {
+			t.Fatalf("Write dropped: %v", err)
+		}
+		dw.WriteLevel(DEBUG, []byte("debug\n"))
+	}
+	if err := dw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if !strings.Contains(mw.String(), fmt.Sprintf("text %d\n", i)) {
+			t.Errorf("text %d lost", i)
+		}
+	}
+	if dw.Dropped() == 0 {
+		t.Error("DEBUG lines should be dropped when the queue is full")
+	}
+}
+
+// closeCheckWriter 记录 Close 之后的写入
+type closeCheckWriter struct {
+	memWriter
+	closed    int32
+	lateWrite int32
+}
+
+func (c *closeCheckWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		atomic.AddInt32(&c.lateWrite, 1)
+	}
+	return c.memWriter.Write(p)
+}
+
+func (c *closeCheckWriter) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+// TestCloseContextAbandon ctx 结束时 CloseContext 返回放弃的条数，关闭底层writer之后不再写入
+func TestCloseContextAbandon(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		cw := &closeCheckWriter{memWriter: memWriter{delay: 2 * time.Millisecond}}
+		dw := NewDLogWriterWithConfig(cw, DLogWriterConfig{Console: ConsoleOff, BatchCount: 1})
+		for n := 0; n < 50; n++ {
+			dw.Write([]byte("line\n"))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		err := dw.CloseContext(ctx)
+		cancel()
+		if err == nil || !strings.Contains(err.Error(), "abandoned") {
+			t.Fatalf("CloseContext = %v, want abandoned error", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if n := atomic.LoadInt32(&cw.lateWrite); n > 0 {
+			t.Fatalf("%d writes after the sink was closed", n)
+		}
+	}
+}
+
+// TestConsoleLevelUnknownLevel ConsoleLevel 不过滤通过 Write 写入、不知道级别的日志
+func TestConsoleLevelUnknownLevel(t *testing.T) {
+	console := new(memWriter)
+	dw := NewDLogWriterWithConfig(new(memWriter), DLogWriterConfig{ConsoleLevel: WARN})
+	dw.console = console
+	dw.Write([]byte("text error\n"))
+	dw.WriteLevel(INFO, []byte("json info\n"))
+	dw.WriteLevel(ERROR, []byte("json error\n"))
+	if err := dw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := console.String(), "text error\njson error\n"; got != want {
+		t.Errorf("console got %q, want %q", got, want)
+	}
+}